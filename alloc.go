@@ -0,0 +1,142 @@
+package pikago
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//Allocator 为message的Body分配内存
+//可以用SetAllocator设置全局的Allocator，也可以用OptionAllocator为一个socket接收的message单独设置
+//实现必须可以被多个goroutine同时使用
+type Allocator interface {
+
+	//Alloc 返回一个长度为0、容量至少为size的[]byte
+	Alloc(size int) []byte
+
+	//Free 归还一个Alloc返回的[]byte，message释放时调用，之后不会再使用它
+	Free(b []byte)
+}
+
+//AllocStats 是PoolAllocator的统计数据
+type AllocStats struct {
+	Hits     uint64 // 从缓存中取得的次数
+	Misses   uint64 // 缓存为空而新分配的次数，这些内存释放后会被缓存
+	Unpooled uint64 // 超过最大一级而直接分配、不会被缓存的次数
+}
+
+//PoolAllocator 是按大小分级缓存内存的Allocator，每一级用一个sync.Pool
+//分配时使用不小于size的最小一级，超过最大一级时直接分配
+type PoolAllocator struct {
+	hits     uint64
+	misses   uint64
+	unpooled uint64
+	classes  []int
+	pools    []sync.Pool
+}
+
+//defaultClasses 是默认的分级，从64字节到OptionMaxRecvSize的默认值，每级翻倍
+func defaultClasses() []int {
+	var classes []int
+	for sz := 64; sz <= defaultMaxRwSize; sz *= 2 {
+		classes = append(classes, sz)
+	}
+	return classes
+}
+
+//NewPoolAllocator 按给定的各级大小创建PoolAllocator，为空时使用默认的分级
+//大于OptionMaxRecvSize的级别不会被接收的message用到。大小不是正数时返回ErrBadValue
+func NewPoolAllocator(classes ...int) (*PoolAllocator, error) {
+	if len(classes) == 0 {
+		classes = defaultClasses()
+	}
+	classes = append([]int{}, classes...)
+	sort.Ints(classes)
+	n := 0
+	for _, sz := range classes {
+		if sz <= 0 {
+			return nil, ErrBadValue
+		}
+		if n > 0 && classes[n-1] == sz {
+			continue
+		}
+		classes[n] = sz
+		n++
+	}
+	a := &PoolAllocator{classes: classes[:n]}
+	a.pools = make([]sync.Pool, n)
+	return a, nil
+}
+
+//class 返回容纳size的最小一级，没有时返回-1
+func (a *PoolAllocator) class(size int) int {
+	i := sort.SearchInts(a.classes, size)
+	if i == len(a.classes) {
+		return -1
+	}
+	return i
+}
+
+//Alloc 实现Allocator
+func (a *PoolAllocator) Alloc(size int) []byte {
+	i := a.class(size)
+	if i < 0 {
+		atomic.AddUint64(&a.unpooled, 1)
+		return make([]byte, 0, size)
+	}
+	if b, ok := a.pools[i].Get().(*[]byte); ok {
+		atomic.AddUint64(&a.hits, 1)
+		return (*b)[:0]
+	}
+	atomic.AddUint64(&a.misses, 1)
+	return make([]byte, 0, a.classes[i])
+}
+
+//Free 实现Allocator，只缓存容量恰好是某一级大小的[]byte
+func (a *PoolAllocator) Free(b []byte) {
+	if i := a.class(cap(b)); i >= 0 && a.classes[i] == cap(b) {
+		b = b[:0]
+		a.pools[i].Put(&b)
+	}
+}
+
+//Stats 返回统计数据
+func (a *PoolAllocator) Stats() AllocStats {
+	return AllocStats{
+		Hits:     atomic.LoadUint64(&a.hits),
+		Misses:   atomic.LoadUint64(&a.misses),
+		Unpooled: atomic.LoadUint64(&a.unpooled),
+	}
+}
+
+//Classes 返回各级的大小
+func (a *PoolAllocator) Classes() []int {
+	return append([]int{}, a.classes...)
+}
+
+type allocHolder struct {
+	a Allocator
+}
+
+var (
+	defaultAllocator, _ = NewPoolAllocator()
+	globalAllocator     atomic.Value // allocHolder
+)
+
+func init() {
+	globalAllocator.Store(allocHolder{defaultAllocator})
+}
+
+//SetAllocator 设置全局的Allocator，没有设置OptionAllocator的socket和NewMessage使用它
+//a为nil时恢复默认的PoolAllocator。已经分配的message仍然归还给分配它的Allocator
+func SetAllocator(a Allocator) {
+	if a == nil {
+		a = defaultAllocator
+	}
+	globalAllocator.Store(allocHolder{a})
+}
+
+//GetAllocator 返回全局的Allocator，默认是一个使用默认分级的*PoolAllocator
+func GetAllocator() Allocator {
+	return globalAllocator.Load().(allocHolder).a
+}
@@ -0,0 +1,221 @@
+package pikago
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+//batchFlushTimeout 是关闭连接时写出剩余message的最长时间
+const batchFlushTimeout = time.Second
+
+//batcher 为开启OptionWriteBatchSize的流式连接合并写操作
+//Send只把message放入队列，由一个goroutine把排队的多个message合并成一次写
+type batcher struct {
+	c     net.Conn
+	lead  bool          // connipc在每个message前面多写一个值为1的字节
+	size  int           // 一次写最多合并的字节数，单个更大的message单独写
+	delay time.Duration // 不足size时最多等待更多message的时间，0表示只合并已经排队的message
+	q     chan *Message
+	cq    chan struct{} // 连接关闭时关闭
+	done  chan struct{} // writer退出时关闭
+	once  sync.Once
+	sends sync.WaitGroup // 正在进行的send，close等它们结束后再清空队列
+
+	err    error // 写失败的原因，之后的Send都返回它
+	closed bool  // close已经开始，之后的send返回ErrClosed
+	sync.Mutex
+}
+
+func newBatcher(c net.Conn, lead bool, size int, delay time.Duration) *batcher {
+	b := &batcher{
+		c:     c,
+		lead:  lead,
+		size:  size,
+		delay: delay,
+		q:     make(chan *Message, defaultQLen),
+		cq:    make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go b.writer()
+	return b
+}
+
+//send 把message放入队列，队列满时阻塞；返回错误时message仍归调用方所有
+//写失败在之后的send返回
+func (b *batcher) send(msg *Message) error {
+	b.Lock()
+	err := b.err
+	if err == nil && b.closed {
+		err = ErrClosed
+	}
+	if err == nil {
+		b.sends.Add(1)
+	}
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+	defer b.sends.Done()
+	select {
+	case b.q <- msg:
+		return nil
+	case <-b.cq:
+		return ErrClosed
+	}
+}
+
+//close 写出已经排队的message后停止writer，最多等待batchFlushTimeout
+//writer退出后才进入队列的message没有机会写出，在这里释放
+func (b *batcher) close() {
+	b.once.Do(func() {
+		b.Lock()
+		b.closed = true
+		b.Unlock()
+		b.c.SetWriteDeadline(time.Now().Add(batchFlushTimeout))
+		close(b.cq)
+	})
+	b.sends.Wait()
+	<-b.done
+	for {
+		select {
+		case m := <-b.q:
+			m.Free()
+		default:
+			return
+		}
+	}
+}
+
+func (b *batcher) frameLen(msg *Message) int {
+	n := 8 + len(msg.Header) + len(msg.Body)
+	if b.lead {
+		n++
+	}
+	return n
+}
+
+func (b *batcher) writer() {
+	defer close(b.done)
+	var (
+		batch []*Message
+		hdrs  []byte
+		bufs  net.Buffers
+		timer *time.Timer
+	)
+
+	for {
+		var msg *Message
+		closing := false
+		select {
+		case msg = <-b.q:
+		case <-b.cq:
+			closing = true
+		}
+
+		batch = batch[:0]
+		n := 0
+		add := func(m *Message) {
+			if m.Expired() {
+				m.Free()
+				return
+			}
+			batch = append(batch, m)
+			n += b.frameLen(m)
+		}
+		if msg != nil {
+			add(msg)
+		}
+
+	collect:
+		for closing || n < b.size {
+			select {
+			case msg = <-b.q:
+				add(msg)
+				continue
+			default:
+			}
+			if closing || b.delay <= 0 {
+				break
+			}
+			if timer == nil {
+				timer = time.NewTimer(b.delay)
+			} else {
+				timer.Reset(b.delay)
+			}
+			select {
+			case msg = <-b.q:
+				add(msg)
+				if !timer.Stop() {
+					<-timer.C
+				}
+			case <-timer.C:
+				break collect
+			case <-b.cq:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				closing = true
+			}
+		}
+
+		if len(batch) > 0 {
+			//先为所有message准备好长度头，append不会再移动hdrs
+			hlen := 8
+			if b.lead {
+				hlen = 9
+			}
+			if len(hdrs) < hlen*len(batch) {
+				hdrs = make([]byte, hlen*len(batch))
+			}
+			bufs = bufs[:0]
+			for i, m := range batch {
+				h := hdrs[i*hlen : (i+1)*hlen]
+				if b.lead {
+					h[0] = 1
+				}
+				binary.BigEndian.PutUint64(h[hlen-8:], uint64(len(m.Header)+len(m.Body)))
+				bufs = append(bufs, h, m.Header, m.Body)
+			}
+			out := bufs //WriteTo会消耗out
+			_, err := out.WriteTo(b.c)
+			for i := range bufs {
+				bufs[i] = nil
+			}
+			for _, m := range batch {
+				m.Free()
+			}
+			if err != nil {
+				b.fail(err)
+				return
+			}
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+//fail 记录写失败，关闭连接让接收方发现，丢弃之后排队的message直到关闭
+func (b *batcher) fail(err error) {
+	b.Lock()
+	b.err = err
+	b.Unlock()
+	b.c.Close()
+	for {
+		select {
+		case m := <-b.q:
+			m.Free()
+		case <-b.cq:
+			for {
+				select {
+				case m := <-b.q:
+					m.Free()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
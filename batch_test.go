@@ -0,0 +1,67 @@
+package pikago
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countAlloc counts the buffers handed out and returned.
+type countAlloc struct {
+	n int64
+}
+
+func (a *countAlloc) Alloc(size int) []byte {
+	atomic.AddInt64(&a.n, 1)
+	return make([]byte, 0, size)
+}
+
+func (a *countAlloc) Free(b []byte) {
+	atomic.AddInt64(&a.n, -1)
+}
+
+// Every message either goes to the writer or back to the sender, even
+// when senders blocked on a full queue race with close.
+func TestBatcherCloseFreesQueued(t *testing.T) {
+	a := &countAlloc{}
+	for i := 0; i < 50; i++ {
+		c, r := net.Pipe()
+		b := newBatcher(c, false, 4096, 0)
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < cap(b.q); k++ {
+					m := AllocMessage(a, 16)
+					m.Body = append(m.Body, "0123456789abcdef"...)
+					if b.send(m) != nil {
+						m.Free()
+					}
+				}
+			}()
+		}
+		// Nothing is read yet, so the writer blocks and the queue fills.
+		for len(b.q) < cap(b.q) {
+			time.Sleep(time.Millisecond)
+		}
+		closed := make(chan struct{})
+		go func() {
+			b.close()
+			close(closed)
+		}()
+		time.Sleep(time.Millisecond)
+		go io.Copy(ioutil.Discard, r)
+		<-closed
+		wg.Wait()
+		c.Close()
+		r.Close()
+	}
+	if n := atomic.LoadInt64(&a.n); n != 0 {
+		t.Fatalf("%d messages not freed", n)
+	}
+}
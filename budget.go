@@ -0,0 +1,111 @@
+package pikago
+
+import (
+	"sync"
+	"time"
+)
+
+//byteBudget 统计一个socket上一个方向排队message占用的字节数
+//包括socket的读或写队列和protocol内部每个peer的队列，超出上限时申请方将阻塞
+type byteBudget struct {
+	max  int           // 0表示不限制
+	used int           // 当前占用的字节数
+	wait int           // 正在等待预算的数量
+	wake chan struct{} // 有等待方时，释放或调整上限会关闭并重建它
+	sync.Mutex
+}
+
+func newByteBudget() *byteBudget {
+	return &byteBudget{wake: make(chan struct{})}
+}
+
+//fits 判断是否可以再占用n字节，调用方必须持有锁
+//当前没有任何占用时总是允许，避免单个超大message永远无法通过
+func (b *byteBudget) fits(n int) bool {
+	return b.max == 0 || b.used == 0 || b.used+n <= b.max
+}
+
+//tryCharge 尝试为message占用字节数，不阻塞
+func (b *byteBudget) tryCharge(m *Message) bool {
+	n := len(m.Header) + len(m.Body)
+	b.Lock()
+	if !b.fits(n) {
+		b.Unlock()
+		return false
+	}
+	b.used += n
+	b.Unlock()
+	m.budget = b
+	m.bcharge = n
+	return true
+}
+
+//charge 为message占用字节数，预算不足时阻塞
+//超时返回ErrSendTimeout，cq1或cq2关闭时返回ErrClosed，nil channel表示不关心
+func (b *byteBudget) charge(m *Message, timeout <-chan time.Time, cq1, cq2 <-chan struct{}) error {
+	n := len(m.Header) + len(m.Body)
+	for {
+		b.Lock()
+		if b.fits(n) {
+			b.used += n
+			b.Unlock()
+			m.budget = b
+			m.bcharge = n
+			return nil
+		}
+		wake := b.wake
+		b.wait++
+		b.Unlock()
+
+		var err error
+		select {
+		case <-wake:
+		case <-timeout:
+			err = ErrSendTimeout
+		case <-cq1:
+			err = ErrClosed
+		case <-cq2:
+			err = ErrClosed
+		}
+		b.Lock()
+		b.wait--
+		b.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//wakeup 唤醒所有等待方，调用方必须持有锁
+func (b *byteBudget) wakeup() {
+	if b.wait > 0 {
+		close(b.wake)
+		b.wake = make(chan struct{})
+	}
+}
+
+func (b *byteBudget) release(n int) {
+	b.Lock()
+	b.used -= n
+	b.wakeup()
+	b.Unlock()
+}
+
+func (b *byteBudget) setMax(max int) {
+	b.Lock()
+	b.max = max
+	b.wakeup()
+	b.Unlock()
+}
+
+func (b *byteBudget) getMax() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.max
+}
+
+func (b *byteBudget) inUse() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.used
+}
@@ -1,17 +1,28 @@
 package pikago
 
 import "net"
+import "bufio"
 import "encoding/binary"
 import "io"
+import "time"
 
 //conn 实现Pipe接口
 type conn struct {
 	c     net.Conn
+	r     io.Reader // c，或者开启OptionReadBufferSize时包装c的bufio.Reader
 	proto Protocol
 	sock  Socket
 	open  bool
 	props map[string]interface{}
 	maxrw int64
+	alloc Allocator
+
+	//以下只由发送方或接收方各自使用，避免每个message分配内存
+	sbuf [9]byte     // 发送的长度头，connipc在前面多一个字节
+	rbuf [9]byte     // 接收的长度头
+	bufs net.Buffers // 一次writev写出的长度头、Header和Body
+
+	batch *batcher // 开启OptionWriteBatchSize时合并写
 }
 
 //connipc 几乎像是一条正常的conn,但IPC协议坚持填充头字节(值为 1)的messages
@@ -21,20 +32,21 @@ type connipc struct {
 }
 
 func (p *conn) Recv() (*Message, error) {
-	var sz int64
-	var err error
-	var msg *Message
-
-	if err = binary.Read(p.c, binary.BigEndian, &sz); err != nil {
+	if _, err := io.ReadFull(p.r, p.rbuf[:8]); err != nil {
 		return nil, err
 	}
+	return p.recvBody(int64(binary.BigEndian.Uint64(p.rbuf[:8])))
+}
 
+//recvBody 读取长度为sz的message
+func (p *conn) recvBody(sz int64) (*Message, error) {
+	//限制messages最大接收值,这避免了潜在的拒绝服务
 	if sz < 0 || (p.maxrw > 0 && sz > p.maxrw) {
 		return nil, ErrTooLong
 	}
-	msg = NewMessage(int(sz))
+	msg := AllocMessage(p.alloc, int(sz))
 	msg.Body = msg.Body[0:sz]
-	if _, err = io.ReadFull(p.c, msg.Body); err != nil {
+	if _, err := io.ReadFull(p.r, msg.Body); err != nil {
 		msg.Free()
 		return nil, err
 	}
@@ -42,21 +54,27 @@ func (p *conn) Recv() (*Message, error) {
 }
 
 func (p *conn) Send(msg *Message) error {
-	sz := uint64(len(msg.Header) + len(msg.Body))
-
+	if p.batch != nil {
+		return p.batch.send(msg)
+	}
 	if msg.Expired() {
 		msg.Free()
 		return nil
 	}
 
 	//写入头长度
-	if err := binary.Write(p.c, binary.BigEndian, sz); err != nil {
-		return err
-	}
-	if _, err := p.c.Write(msg.Header); err != nil {
-		return err
-	}
-	if _, err := p.c.Write(msg.Body); err != nil {
+	binary.BigEndian.PutUint64(p.sbuf[:8], uint64(len(msg.Header)+len(msg.Body)))
+	return p.write(p.sbuf[:8], msg)
+}
+
+//write 用一次writev写出长度头、Header和Body，成功后释放message
+//不支持writev的net.Conn(例如TLS)由net.Buffers依次写出
+func (p *conn) write(prefix []byte, msg *Message) error {
+	p.bufs = append(p.bufs[:0], prefix, msg.Header, msg.Body)
+	bufs := p.bufs //WriteTo会消耗bufs
+	_, err := bufs.WriteTo(p.c)
+	p.bufs[1], p.bufs[2] = nil, nil
+	if err != nil {
 		return err
 	}
 	msg.Free()
@@ -74,6 +92,9 @@ func (p *conn) RemoteProtocol() uint16 {
 
 func (p *conn) Close() error {
 	p.open = false
+	if p.batch != nil {
+		p.batch.close()
+	}
 	return p.c.Close()
 }
 
@@ -94,75 +115,71 @@ func (p *conn) GetProp(n string) (interface{}, error) {
 //面向流的传输可以利用这个来实现传输。实现还需要实现PipeDialer PipeAccepter,Transport结构
 //使用这个分层的接口，一旦建立了底层连接，实现就不必为传递实际的SP消息而烦恼了
 func NewConnPipe(c net.Conn, sock Socket, props ...interface{}) (Pipe, error) {
-	p := &conn{c: c, proto: sock.GetProtocol(), sock: sock}
+	p := &conn{c: c, r: c, proto: sock.GetProtocol(), sock: sock}
 
 	if err := p.handshake(props); err != nil {
 		return nil, err
 	}
+	p.buffer()
+	p.batching(false)
 
 	return p, nil
 }
 
 // NewConnPipeIPC分配一个新的Pipe使用IPC交换协议。
 func NewConnPipeIPC(c net.Conn, sock Socket, props ...interface{}) (Pipe, error) {
-	p := &connipc{conn: conn{c: c, proto: sock.GetProtocol(), sock: sock}}
+	p := &connipc{conn: conn{c: c, r: c, proto: sock.GetProtocol(), sock: sock}}
 
 	if err := p.handshake(props); err != nil {
 		return nil, err
 	}
+	p.buffer()
+	p.batching(true)
 
 	return p, nil
 }
 
-func (p *connipc) Send(msg *Message) error {
-
-	l := uint64(len(msg.Header) + len(msg.Body))
-	one := [1]byte{1}
-	var err error
-
-	// send length header
-	if _, err = p.c.Write(one[:]); err != nil {
-		return err
-	}
-	if err = binary.Write(p.c, binary.BigEndian, l); err != nil {
-		return err
-	}
-	if _, err = p.c.Write(msg.Header); err != nil {
-		return err
+//buffer 在开启OptionReadBufferSize时缓冲读取，一次系统调用可以读到多个小message
+//握手直接从c读取，之后才开始缓冲，因此不会多读握手的数据
+func (p *conn) buffer() {
+	if v, err := p.sock.GetOption(OptionReadBufferSize); err == nil && v.(int) > 0 {
+		p.r = bufio.NewReaderSize(p.c, v.(int))
 	}
-
-	if _, err = p.c.Write(msg.Body); err != nil {
-		return err
-	}
-	msg.Free()
-	return nil
 }
 
-func (p *connipc) Recv() (*Message, error) {
-
-	var sz int64
-	var err error
-	var msg *Message
-	var one [1]byte
-
-	if _, err = p.c.Read(one[:]); err != nil {
-		return nil, err
+//batching 在开启OptionWriteBatchSize时启动合并写，lead表示connipc的前导字节
+func (p *conn) batching(lead bool) {
+	v, err := p.sock.GetOption(OptionWriteBatchSize)
+	if err != nil || v.(int) <= 0 {
+		return
 	}
-	if err = binary.Read(p.c, binary.BigEndian, &sz); err != nil {
-		return nil, err
+	var delay time.Duration
+	if d, err := p.sock.GetOption(OptionWriteBatchDelay); err == nil {
+		delay = d.(time.Duration)
 	}
+	p.batch = newBatcher(p.c, lead, v.(int), delay)
+}
 
-	//限制messages最大接收值,这避免了潜在的拒绝服务
-	if sz < 0 || (p.maxrw > 0 && sz > p.maxrw) {
-		return nil, ErrTooLong
+func (p *connipc) Send(msg *Message) error {
+	if p.batch != nil {
+		return p.batch.send(msg)
 	}
-	msg = NewMessage(int(sz))
-	msg.Body = msg.Body[0:sz]
-	if _, err = io.ReadFull(p.c, msg.Body); err != nil {
+	if msg.Expired() {
 		msg.Free()
+		return nil
+	}
+
+	// send length header
+	p.sbuf[0] = 1
+	binary.BigEndian.PutUint64(p.sbuf[1:], uint64(len(msg.Header)+len(msg.Body)))
+	return p.write(p.sbuf[:], msg)
+}
+
+func (p *connipc) Recv() (*Message, error) {
+	if _, err := io.ReadFull(p.r, p.rbuf[:]); err != nil {
 		return nil, err
 	}
-	return msg, nil
+	return p.recvBody(int64(binary.BigEndian.Uint64(p.rbuf[1:])))
 }
 
 type connHeader struct {
@@ -171,9 +188,19 @@ type connHeader struct {
 	P       byte // 'P'
 	Version byte // only zero at present
 	Proto   uint16
-	Rsvd    uint16 // always zero at present
+	Rsvd    uint16 // extension flags, zero from nanomsg peers
 }
 
+//以下是握手头中Rsvd字段的扩展标志位，由ProtocolExtender声明
+//nanomsg的peer总是发送0，因此不会开启任何扩展
+const (
+	//ExtPubFilter 表示SUB把订阅发送给PUB，由PUB按peer过滤，见OptionPublisherFilter
+	ExtPubFilter uint16 = 1 << iota
+
+	//ExtBusHeader 表示BUS的message带有来源、序号和跳数，用于去重和防止环路，见OptionBusDedup
+	ExtBusHeader
+)
+
 func (p *conn) handshake(props []interface{}) error {
 	var err error
 
@@ -195,8 +222,16 @@ func (p *conn) handshake(props []interface{}) error {
 		//socket保证这是一个整数
 		p.maxrw = int64(v.(int))
 	}
+	if v, e := p.sock.GetOption(OptionAllocator); e == nil && v != nil {
+		p.alloc = v.(Allocator)
+	}
 
-	h := connHeader{S: 'S', P: 'P', Proto: p.proto.Number()}
+	var ext uint16
+	if x, ok := p.proto.(ProtocolExtender); ok {
+		ext = x.Extensions()
+	}
+
+	h := connHeader{S: 'S', P: 'P', Proto: p.proto.Number(), Rsvd: ext}
 	if err = binary.Write(p.c, binary.BigEndian, &h); err != nil {
 		return err
 	}
@@ -204,11 +239,14 @@ func (p *conn) handshake(props []interface{}) error {
 		p.c.Close()
 		return err
 	}
-	if h.Zero != 0 || h.S != 'S' || h.P != 'P' || h.Rsvd != 0 {
+	if h.Zero != 0 || h.S != 'S' || h.P != 'P' {
 		p.c.Close()
 		return ErrBadHeader
 	}
 
+	//Rsvd是peer声明的扩展，不认识的标志被忽略
+	p.props[PropExtensions] = ext & h.Rsvd
+
 	//目前唯一支持的版本号是“0”,at offset 3.
 	if h.Version != 0 {
 		p.c.Close()
@@ -1,6 +1,7 @@
 package pikago
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -38,8 +39,24 @@ type socket struct {
 	linger     time.Duration
 	maxRwSize  int // max recv size
 
+	rbudget *byteBudget // 接收方向排队message的字节预算
+	wbudget *byteBudget // 发送方向排队message的字节预算，与rbudget分开，未读取的message不会阻塞发送
+	alloc   Allocator   // OptionAllocator，为nil时使用全局的Allocator
+
+	rbufSize   int           // OptionReadBufferSize
+	batchSize  int           // OptionWriteBatchSize
+	batchDelay time.Duration // OptionWriteBatchDelay
+
+	sendprio int // 新Port默认的发送优先级
+	recvprio int // 新Port默认的接收优先级
+	weight   int // 新Port默认的接收权重
+
 	pipes []*pipe
 
+	npeers   int           // 已经交给protocol的pipe数量
+	peerq    chan struct{} // npeers变化时关闭并重建
+	waitpeer bool          // true if OptionSendWaitForPeer is set
+
 	listeners []*listener
 
 	transports map[string]Transport
@@ -47,6 +64,7 @@ type socket struct {
 	// These are conditional "type aliases" for our self
 	sendhook ProtocolSendHook
 	recvhook ProtocolRecvHook
+	prophook ProtocolPropHook
 
 	// Port hook -- called when a port is added or removed
 	porthook PortHook
@@ -56,6 +74,7 @@ func (sock *socket) addPipe(transport Pipe, d *dialer, l *listener) *pipe {
 	p := newPipe(transport)
 	p.d = d
 	p.l = l
+	p.prophook = sock.prophook
 
 	if l == nil && d == nil {
 		p.Close()
@@ -63,6 +82,12 @@ func (sock *socket) addPipe(transport Pipe, d *dialer, l *listener) *pipe {
 	}
 
 	sock.Lock()
+	//socket已经关闭，Close不会再看到这个pipe，这里直接关闭它，dialer随后退出
+	if sock.closing {
+		sock.Unlock()
+		p.Close()
+		return nil
+	}
 	if fn := sock.porthook; fn != nil {
 		sock.Unlock()
 		if !fn(PortActionAdd, p) {
@@ -71,11 +96,28 @@ func (sock *socket) addPipe(transport Pipe, d *dialer, l *listener) *pipe {
 		}
 		sock.Lock()
 	}
+	//在pipe的锁内设置sock，pipe.Close要么看到它并重新dial，要么在这之前已经关闭，由dialer重试
+	p.Lock()
+	if p.closing {
+		p.Unlock()
+		sock.Unlock()
+		return nil
+	}
 	p.sock = sock
+	p.Unlock()
 	p.index = len(sock.pipes)
 	sock.pipes = append(sock.pipes, p)
 	sock.Unlock()
 	sock.proto.AddEndpoint(p)
+
+	//protocol已经可以使用这个pipe，这时才唤醒等待peer的调用方
+	sock.Lock()
+	if p.index >= 0 {
+		p.counted = true
+		sock.npeers++
+		sock.peersChanged()
+	}
+	sock.Unlock()
 	return p
 }
 
@@ -88,9 +130,58 @@ func (sock *socket) remPipe(p *pipe) {
 		sock.pipes = sock.pipes[:len(sock.pipes)-1]
 		p.index = -1
 	}
+	if p.counted {
+		p.counted = false
+		sock.npeers--
+		sock.peersChanged()
+	}
 	sock.Unlock()
 }
 
+//peersChanged 唤醒等待peer的调用方，调用方必须持有锁
+func (sock *socket) peersChanged() {
+	close(sock.peerq)
+	sock.peerq = make(chan struct{})
+}
+
+//waitPeers 等待至少n个peer连接，timeout或done先到时返回对应的错误
+func (sock *socket) waitPeers(n int, timeout <-chan time.Time, done <-chan struct{}) error {
+	for {
+		sock.Lock()
+		if sock.closing {
+			sock.Unlock()
+			return ErrClosed
+		}
+		if sock.npeers >= n {
+			sock.Unlock()
+			return nil
+		}
+		peerq := sock.peerq
+		sock.Unlock()
+
+		select {
+		case <-peerq:
+		case <-timeout:
+			return ErrSendTimeout
+		case <-done:
+			return context.Canceled
+		case <-sock.closeq:
+			return ErrClosed
+		}
+	}
+}
+
+//WaitForPeers 阻塞直到socket至少有n个已连接的peer
+//ctx结束时返回ctx.Err()，socket关闭时返回ErrClosed
+func (sock *socket) WaitForPeers(ctx context.Context, n int) error {
+	if err := sock.waitPeers(n, nil, ctx.Done()); err == context.Canceled {
+		return ctx.Err()
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
 func newSocket(proto Protocol) *socket {
 	sock := new(socket)
 	sock.wqLen = defaultQLen
@@ -98,6 +189,7 @@ func newSocket(proto Protocol) *socket {
 	sock.wq = make(chan *Message, sock.wqLen)
 	sock.rq = make(chan *Message, sock.rqLen)
 	sock.closeq = make(chan struct{})
+	sock.peerq = make(chan struct{})
 	sock.recverrq = make(chan struct{})
 	sock.reconntime = time.Millisecond * 100
 	sock.reconnmax = time.Duration(0)
@@ -105,6 +197,11 @@ func newSocket(proto Protocol) *socket {
 	sock.transports = make(map[string]Transport)
 	sock.linger = time.Second
 	sock.maxRwSize = defaultMaxRwSize
+	sock.rbudget = newByteBudget()
+	sock.wbudget = newByteBudget()
+	sock.sendprio = defaultPriority
+	sock.recvprio = defaultPriority
+	sock.weight = defaultWeight
 
 	// Add some conditionals now -- saves checks later
 	if i, ok := interface{}(proto).(ProtocolRecvHook); ok {
@@ -113,6 +210,9 @@ func newSocket(proto Protocol) *socket {
 	if i, ok := interface{}(proto).(ProtocolSendHook); ok {
 		sock.sendhook = i.(ProtocolSendHook)
 	}
+	if i, ok := interface{}(proto).(ProtocolPropHook); ok {
+		sock.prophook = i.(ProtocolPropHook)
+	}
 
 	proto.Init(sock)
 
@@ -189,6 +289,34 @@ func (sock *socket) Close() error {
 }
 
 func (sock *socket) SendMsg(msg *Message) error {
+	return sock.send(msg, nil)
+}
+
+//send 把message交给protocol，target不为nil时只发给该Endpoint
+//成功时message归socket所有；失败时仍归调用方所有，由调用方决定是否释放
+func (sock *socket) send(msg *Message, target Endpoint) error {
+	if debugging() {
+		msg.check("send")
+	}
+	//protocol会修改Header，共享的message先复制一份，发送成功后才释放调用方的引用
+	m := msg
+	if msg.shared() {
+		m = msg.clone()
+	}
+	err := sock.sendOwned(m, target)
+	if m != msg {
+		if err == nil {
+			msg.Free()
+		} else {
+			m.Free()
+		}
+	}
+	return err
+}
+
+//sendOwned 是send的实现，msg已经可以修改
+func (sock *socket) sendOwned(msg *Message, target Endpoint) error {
+	msg.target = target
 
 	sock.Lock()
 	e := sock.senderr
@@ -206,6 +334,7 @@ func (sock *socket) SendMsg(msg *Message) error {
 	}
 	sock.Lock()
 	useBestEffort := sock.bestEffort
+	waitpeer := sock.waitpeer
 	if sock.wdeadline != 0 {
 		msg.expire = time.Now().Add(sock.wdeadline)
 	} else {
@@ -215,17 +344,32 @@ func (sock *socket) SendMsg(msg *Message) error {
 
 	if !useBestEffort {
 		timeout := mkTimer(sock.wdeadline)
+		if waitpeer {
+			if err := sock.waitPeers(1, timeout, nil); err != nil {
+				return err
+			}
+		}
+		if err := sock.wbudget.charge(msg, timeout, sock.closeq, nil); err != nil {
+			return err
+		}
 		select {
 		case <-timeout:
+			msg.uncharge()
 			return ErrSendTimeout
 		case <-sock.closeq:
+			msg.uncharge()
 			return ErrClosed
 		case sock.wq <- msg:
 			return nil
 		}
 	} else {
+		if !sock.wbudget.tryCharge(msg) {
+			msg.Free()
+			return nil
+		}
 		select {
 		case <-sock.closeq:
+			msg.uncharge()
 			return ErrClosed
 		case sock.wq <- msg:
 			return nil
@@ -236,10 +380,35 @@ func (sock *socket) SendMsg(msg *Message) error {
 	}
 }
 
+func (sock *socket) SendTo(port Port, msg *Message) error {
+	if t, ok := sock.proto.(ProtocolTargeter); !ok || !t.CanSendTo() {
+		return ErrProtoOp
+	}
+	p, ok := port.(*pipe)
+	if !ok {
+		return ErrBadPort
+	}
+	sock.Lock()
+	//counted说明protocol已经添加、还没有移除这个pipe
+	ok = p.sock == sock && p.counted
+	sock.Unlock()
+	if !ok {
+		return ErrBadPort
+	}
+	return sock.send(msg, p)
+}
+
 func (sock *socket) Send(b []byte) error {
-	msg := NewMessage(len(b))
+	sock.Lock()
+	a := sock.alloc
+	sock.Unlock()
+	msg := AllocMessage(a, len(b))
 	msg.Body = append(msg.Body, b...)
-	return sock.SendMsg(msg)
+	if err := sock.SendMsg(msg); err != nil {
+		msg.Free()
+		return err
+	}
+	return nil
 }
 
 func (sock *socket) String() string {
@@ -264,10 +433,12 @@ func (sock *socket) RecvMsg() (*Message, error) {
 		case msg := <-sock.rq:
 			if sock.recvhook != nil {
 				if ok := sock.recvhook.RecvHook(msg); ok {
+					msg.uncharge()
 					return msg, nil
 				} // else loop
 				msg.Free()
 			} else {
+				msg.uncharge()
 				return msg, nil
 			}
 		case <-sock.closeq:
@@ -328,6 +499,7 @@ func (sock *socket) Dial(addr string) error {
 func (sock *socket) NewDialer(addr string, options map[string]interface{}) (Dialer, error) {
 	var err error
 	d := &dialer{sock: sock, addr: addr, closeq: make(chan struct{})}
+	d.opts = make(portOptions)
 	t := sock.getTransport(addr)
 	if t == nil {
 		return nil, ErrBadTran
@@ -336,7 +508,7 @@ func (sock *socket) NewDialer(addr string, options map[string]interface{}) (Dial
 		return nil, err
 	}
 	for n, v := range options {
-		if err = d.d.SetOption(n, v); err != nil {
+		if err = d.SetOption(n, v); err != nil {
 			return nil, err
 		}
 	}
@@ -368,13 +540,13 @@ func (sock *socket) NewListener(addr string, options map[string]interface{}) (Li
 		return nil, ErrBadTran
 	}
 	var err error
-	l := &listener{sock: sock, addr: addr}
+	l := &listener{sock: sock, addr: addr, opts: make(portOptions)}
 	l.l, err = t.NewListener(addr, sock)
 	if err != nil {
 		return nil, err
 	}
 	for n, v := range options {
-		if err = l.l.SetOption(n, v); err != nil {
+		if err = l.SetOption(n, v); err != nil {
 			l.l.Close()
 			return nil, err
 		}
@@ -447,6 +619,42 @@ func (sock *socket) SetOption(name string, value interface{}) error {
 		default:
 			return ErrBadValue
 		}
+	case OptionMaxBufferedBytes:
+		switch value := value.(type) {
+		case int:
+			if value < 0 {
+				return ErrBadValue
+			}
+			sock.rbudget.setMax(value)
+			sock.wbudget.setMax(value)
+			return nil
+		default:
+			return ErrBadValue
+		}
+	case OptionSendPriority:
+		if err := checkPriority(value); err != nil {
+			return err
+		}
+		sock.Lock()
+		sock.sendprio = value.(int)
+		sock.Unlock()
+		return nil
+	case OptionRecvPriority:
+		if err := checkPriority(value); err != nil {
+			return err
+		}
+		sock.Lock()
+		sock.recvprio = value.(int)
+		sock.Unlock()
+		return nil
+	case OptionRecvWeight:
+		if err := checkWeight(value); err != nil {
+			return err
+		}
+		sock.Lock()
+		sock.weight = value.(int)
+		sock.Unlock()
+		return nil
 	case OptionReconnectTime:
 		sock.Lock()
 		sock.reconntime = value.(time.Duration)
@@ -462,6 +670,47 @@ func (sock *socket) SetOption(name string, value interface{}) error {
 		sock.bestEffort = value.(bool)
 		sock.Unlock()
 		return nil
+	case OptionSendWaitForPeer:
+		sock.Lock()
+		sock.waitpeer = value.(bool)
+		sock.Unlock()
+		return nil
+	case OptionWriteBatchSize:
+		size, ok := value.(int)
+		if !ok || size < 0 {
+			return ErrBadValue
+		}
+		sock.Lock()
+		sock.batchSize = size
+		sock.Unlock()
+		return nil
+	case OptionWriteBatchDelay:
+		delay, ok := value.(time.Duration)
+		if !ok || delay < 0 {
+			return ErrBadValue
+		}
+		sock.Lock()
+		sock.batchDelay = delay
+		sock.Unlock()
+		return nil
+	case OptionReadBufferSize:
+		size, ok := value.(int)
+		if !ok || size < 0 {
+			return ErrBadValue
+		}
+		sock.Lock()
+		sock.rbufSize = size
+		sock.Unlock()
+		return nil
+	case OptionAllocator:
+		a, ok := value.(Allocator)
+		if !ok && value != nil {
+			return ErrBadValue
+		}
+		sock.Lock()
+		sock.alloc = a
+		sock.Unlock()
+		return nil
 	}
 	if matched {
 		return nil
@@ -503,6 +752,42 @@ func (sock *socket) GetOption(name string) (interface{}, error) {
 		sock.Lock()
 		defer sock.Unlock()
 		return sock.maxRwSize, nil
+	case OptionMaxBufferedBytes:
+		return sock.wbudget.getMax(), nil
+	case OptionBufferedBytes:
+		return sock.rbudget.inUse() + sock.wbudget.inUse(), nil
+	case OptionSendPriority:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.sendprio, nil
+	case OptionRecvPriority:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.recvprio, nil
+	case OptionRecvWeight:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.weight, nil
+	case OptionSendWaitForPeer:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.waitpeer, nil
+	case OptionAllocator:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.alloc, nil
+	case OptionReadBufferSize:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.rbufSize, nil
+	case OptionWriteBatchSize:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.batchSize, nil
+	case OptionWriteBatchDelay:
+		sock.Lock()
+		defer sock.Unlock()
+		return sock.batchDelay, nil
 	case OptionReconnectTime:
 		sock.Lock()
 		defer sock.Unlock()
@@ -534,6 +819,8 @@ type dialer struct {
 	closed bool
 	active bool
 	closeq chan struct{}
+	opts   portOptions
+	rtime  time.Duration // 下一次重连前等待的时间
 }
 
 func (d *dialer) Dial() error {
@@ -543,10 +830,11 @@ func (d *dialer) Dial() error {
 		return ErrAddrInUse
 	}
 	d.closeq = make(chan struct{})
+	d.rtime = d.sock.reconntime
 	d.sock.active = true
 	d.active = true
 	d.sock.Unlock()
-	go d.dialer()
+	go d.dialer(false)
 	return nil
 }
 
@@ -563,10 +851,22 @@ func (d *dialer) Close() error {
 }
 
 func (d *dialer) GetOption(n string) (interface{}, error) {
+	d.sock.Lock()
+	v, err := d.opts.get(n)
+	d.sock.Unlock()
+	if err != ErrBadOption {
+		return v, err
+	}
 	return d.d.GetOption(n)
 }
 
 func (d *dialer) SetOption(n string, v interface{}) error {
+	d.sock.Lock()
+	err := d.opts.set(n, v)
+	d.sock.Unlock()
+	if err != ErrBadOption {
+		return err
+	}
 	return d.d.SetOption(n, v)
 }
 
@@ -574,59 +874,88 @@ func (d *dialer) Address() string {
 	return d.addr
 }
 
-//dialer是用来dial或从goroutine重拨。
-func (d *dialer) dialer() {
-	rtime := d.sock.reconntime
-	rtmax := d.sock.reconnmax
+//dialer 在goroutine中dial，失败时按重连间隔重试，直到得到的pipe交给了socket
+//之后goroutine退出，连接断开时由pipe.Close调用redial重新启动，因此保持连接的dialer不占用goroutine
+//wait为true时先等待一个重连间隔再dial
+func (d *dialer) dialer(wait bool) {
 	for {
-		p, err := d.d.Dial()
-		if err == nil {
-			// reset retry time
-			rtime = d.sock.reconntime
+		if wait {
 			d.sock.Lock()
-			if d.closed {
-				p.Close()
+			if d.closed || d.sock.closing {
+				d.sock.Unlock()
 				return
 			}
-			d.sock.Unlock()
-			if cp := d.sock.addPipe(p, d, nil); cp != nil {
-				select {
-				case <-d.sock.closeq: // parent socket closed
-				case <-cp.closeq: // disconnect event
-				case <-d.closeq: // dialer closed
+			rtime := d.rtime
+			if d.sock.reconnmax > 0 {
+				d.rtime *= 2
+				if d.rtime > d.sock.reconnmax {
+					d.rtime = d.sock.reconnmax
 				}
 			}
+			d.sock.Unlock()
+			select {
+			case <-d.closeq: // dialer closed
+				return
+			case <-d.sock.closeq: // exit if parent socket closed
+				return
+			case <-time.After(rtime):
+			}
 		}
+		wait = true
 
-		// 这里重拨
-		select {
-		case <-d.closeq: // dialer closed
+		p, err := d.d.Dial()
+		if err != nil {
+			continue
+		}
+		d.sock.Lock()
+		if d.closed || d.sock.closing {
+			d.sock.Unlock()
+			p.Close()
 			return
-		case <-d.sock.closeq: // exit if parent socket closed
+		}
+		// reset retry time
+		d.rtime = d.sock.reconntime
+		d.sock.Unlock()
+		if d.sock.addPipe(p, d, nil) != nil {
 			return
-		case <-time.After(rtime):
-			if rtmax > 0 {
-				rtime *= 2
-				if rtime > rtmax {
-					rtime = rtmax
-				}
-			}
-			continue
 		}
 	}
 }
 
+//redial 在dialer的pipe断开后，等待一个重连间隔重新dial；dialer或socket已经关闭时不再重连
+func (d *dialer) redial() {
+	d.sock.Lock()
+	stop := d.closed || d.sock.closing
+	d.sock.Unlock()
+	if !stop {
+		go d.dialer(true)
+	}
+}
+
 type listener struct {
 	l    PipeListener
 	sock *socket
 	addr string
+	opts portOptions
 }
 
 func (l *listener) GetOption(n string) (interface{}, error) {
+	l.sock.Lock()
+	v, err := l.opts.get(n)
+	l.sock.Unlock()
+	if err != ErrBadOption {
+		return v, err
+	}
 	return l.l.GetOption(n)
 }
 
 func (l *listener) SetOption(n string, v interface{}) error {
+	l.sock.Lock()
+	err := l.opts.set(n, v)
+	l.sock.Unlock()
+	if err != ErrBadOption {
+		return err
+	}
 	return l.l.SetOption(n, v)
 }
 
@@ -0,0 +1,207 @@
+package pikago_test
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k4s/pikago"
+	"github.com/k4s/pikago/protocol/bus"
+	"github.com/k4s/pikago/protocol/pair"
+	"github.com/k4s/pikago/protocol/pull"
+	"github.com/k4s/pikago/protocol/push"
+	"github.com/k4s/pikago/protocol/rep"
+	"github.com/k4s/pikago/protocol/req"
+	"github.com/k4s/pikago/protocol/respondent"
+	"github.com/k4s/pikago/protocol/surveyor"
+	"github.com/k4s/pikago/transport/tcp"
+)
+
+func newSocket(tb testing.TB, f func() (pikago.Socket, error)) pikago.Socket {
+	s, err := f()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.AddTransport(tcp.NewTransport())
+	s.SetOption(pikago.OptionReconnectTime, time.Millisecond)
+	return s
+}
+
+// listen starts srv on a free port and counts the pipes it accepts.
+func listen(tb testing.TB, srv pikago.Socket, adds *int32) string {
+	srv.SetPortHook(func(a pikago.PortAction, p pikago.Port) bool {
+		if a == pikago.PortActionAdd {
+			atomic.AddInt32(adds, 1)
+		}
+		return true
+	})
+	l, err := srv.NewListener("tcp://127.0.0.1:0", nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = l.Listen(); err != nil {
+		tb.Fatal(err)
+	}
+	return l.Address()
+}
+
+// waitAdds waits until n pipes were accepted.
+func waitAdds(tb testing.TB, adds *int32, n int32) {
+	for i := 0; atomic.LoadInt32(adds) < n; i++ {
+		if i == 500 {
+			tb.Fatalf("%d of %d connections", atomic.LoadInt32(adds), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// settled waits for the goroutine count to drop back to before.
+func settled(t *testing.T, before int) {
+	n := 0
+	for i := 0; i < 100; i++ {
+		if n = runtime.NumGoroutine(); n <= before {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%d goroutines left, want at most %d", n, before)
+}
+
+func TestNoRedialAfterSocketClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	srv := newSocket(t, pull.NewSocket)
+	cli := newSocket(t, push.NewSocket)
+	var adds int32
+	addr := listen(t, srv, &adds)
+	for i := 0; i < 10; i++ {
+		if err := cli.Dial(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitAdds(t, &adds, 10)
+
+	cli.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&adds); n != 10 {
+		t.Fatalf("%d connections after Close, want 10", n)
+	}
+	srv.Close()
+	settled(t, before)
+}
+
+func TestNoRedialAfterDialerClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	srv := newSocket(t, pull.NewSocket)
+	cli := newSocket(t, push.NewSocket)
+	var adds int32
+	addr := listen(t, srv, &adds)
+	ports := make(chan pikago.Port, 1)
+	cli.SetPortHook(func(a pikago.PortAction, p pikago.Port) bool {
+		if a == pikago.PortActionAdd {
+			ports <- p
+		}
+		return true
+	})
+	d, err := cli.NewDialer(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	port := <-ports
+
+	// The connection drops after the dialer is closed, which would
+	// otherwise start a redial.
+	d.Close()
+	port.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&adds); n != 1 {
+		t.Fatalf("%d connections after Close, want 1", n)
+	}
+	cli.Close()
+	srv.Close()
+	settled(t, before)
+}
+
+func measure() (int, uint64) {
+	runtime.GC()
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return runtime.NumGoroutine(), ms.StackInuse + ms.HeapInuse
+}
+
+// BenchmarkIdleConns reports the goroutines and heap and stack bytes
+// held per idle TCP connection, counting both ends.
+func BenchmarkIdleConns(b *testing.B) {
+	const n = 500
+	cases := []struct {
+		name   string
+		server func() (pikago.Socket, error)
+		client func() (pikago.Socket, error)
+	}{
+		{"PushPull", pull.NewSocket, push.NewSocket},
+		{"ReqRep", rep.NewSocket, req.NewSocket},
+		{"SurveyorRespondent", surveyor.NewSocket, respondent.NewSocket},
+		{"BusBus", bus.NewSocket, bus.NewSocket},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			var gs, bs float64
+			for i := 0; i < b.N; i++ {
+				g0, m0 := measure()
+				srv := newSocket(b, c.server)
+				cli := newSocket(b, c.client)
+				var adds int32
+				addr := listen(b, srv, &adds)
+				for j := 0; j < n; j++ {
+					if err := cli.Dial(addr); err != nil {
+						b.Fatal(err)
+					}
+				}
+				waitAdds(b, &adds, n)
+				time.Sleep(100 * time.Millisecond) // let the dialers exit
+				g1, m1 := measure()
+				gs += float64(g1-g0) / n
+				bs += (float64(m1) - float64(m0)) / n
+				cli.Close()
+				srv.Close()
+			}
+			b.ReportMetric(gs/float64(b.N), "goroutines/conn")
+			b.ReportMetric(bs/float64(b.N), "bytes/conn")
+		})
+	}
+}
+
+// Unread inbound messages must not use up the budget that Send needs.
+func TestUnreadDoesNotBlockSend(t *testing.T) {
+	a := newSocket(t, pair.NewSocket)
+	defer a.Close()
+	b := newSocket(t, pair.NewSocket)
+	defer b.Close()
+	a.SetOption(pikago.OptionMaxBufferedBytes, 200)
+	a.SetOption(pikago.OptionSendDeadline, time.Second)
+	var adds int32
+	addr := listen(t, a, &adds)
+	if err := b.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	waitAdds(t, &adds, 1)
+
+	for i := 0; i < 10; i++ {
+		if err := b.Send(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if v, _ := a.GetOption(pikago.OptionBufferedBytes); v.(int) >= 200 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := a.Send([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,426 @@
+package pikago
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+//KeyFunc 从message中提取路由用的key，返回nil表示该message不按key路由
+type KeyFunc func(*Message) []byte
+
+//ringReplicas 是每个Endpoint在一致性哈希环上的虚拟节点数
+const ringReplicas = 64
+
+//peerQBytes 是每个Endpoint的发送队列最多容纳的字节数，包括正在发送的message，与nanomsg默认的NN_SNDBUF相同
+const peerQBytes = 128 * 1024
+
+//keyQLen 是SendKey在一个Endpoint上最多排队的message数量
+//SendKey不能换用其它Endpoint，按数量限制可以让一个慢的peer排更多message，而不阻塞其它key
+const keyQLen = defaultQLen
+
+//drainLinger 是发送goroutine在队列空了以后等待新message的时间，超过后才退出
+//持续有message但每次只排一个的Endpoint(例如REQ一问一答)因此不会为每个message启动一个goroutine
+const drainLinger = 100 * time.Millisecond
+
+//Dispatcher 供PUSH、REQ这类负载均衡的protocol使用，把message分配给Endpoint
+//每个Endpoint有一个有界的发送队列，队列满时该Endpoint才算忙碌。选择时总是优先使用OptionSendPriority更高、
+//队列未满的Endpoint，同一优先级中最久未使用的Endpoint优先，因此只有在高优先级的peer的队列都满了或者断开时，
+//低优先级的peer才会收到message，与nanomsg的NN_SNDPRIO一致
+//也可以用SendKey按key做一致性哈希路由，这时不考虑优先级
+//每个Endpoint最多有一个发送goroutine，在队列中有message时启动，空了drainLinger之后退出，空闲的Endpoint不占用
+type Dispatcher struct {
+	peers map[uint32]*dispatchPeer
+	seq   uint64        // 用于同一优先级中的轮流选择
+	wait  int           // 正在等待空闲Endpoint的数量
+	wake  chan struct{} // 有Endpoint变为空闲时关闭并重建
+	fail  func(Endpoint, *Message)
+	w     Waiter
+	ring  []ringPoint // 一致性哈希环，按hash排序
+	dirty bool        // Endpoint有变化，哈希环需要重建
+	sync.Mutex
+}
+
+type ringPoint struct {
+	hash uint32
+	peer *dispatchPeer
+}
+
+type dispatchPeer struct {
+	ep      Endpoint
+	prio    int
+	bytes   int           // 交给它还未发送完成的message的字节数，包括正在发送的
+	q       []*Message    // 排队等待发送的message
+	running bool          // 有goroutine正在发送队列中的message，或者在等待新的message
+	kick    chan struct{} // 通知等待中的发送goroutine有新的message
+	dead    bool          // 发送失败，等待被Remove
+	last    uint64
+	until   time.Time // 在此之前被熔断，不再分配message
+}
+
+//full 判断Endpoint是否不能再接收message，调用方必须持有锁
+//只要队列还没有达到peerQBytes就可以再放入一个message，因此超过上限的大message也能发送
+func (dp *dispatchPeer) full() bool {
+	return dp.dead || dp.bytes >= peerQBytes
+}
+
+//Init 初始化Dispatcher
+//fail 在Endpoint发送失败或者移除时调用，接管未发送的message；为nil时直接释放
+func (d *Dispatcher) Init(fail func(Endpoint, *Message)) {
+	d.peers = make(map[uint32]*dispatchPeer)
+	d.wake = make(chan struct{})
+	d.fail = fail
+	d.w.Init()
+}
+
+//Add 添加一个Endpoint，它的优先级取自OptionSendPriority
+func (d *Dispatcher) Add(ep Endpoint) {
+	prio := defaultPriority
+	if v, err := EndpointOption(ep, OptionSendPriority); err == nil {
+		prio = v.(int)
+	}
+	dp := &dispatchPeer{
+		ep:   ep,
+		prio: prio,
+		kick: make(chan struct{}, 1),
+	}
+	d.Lock()
+	d.peers[ep.GetID()] = dp
+	d.dirty = true
+	d.wakeup()
+	d.Unlock()
+}
+
+//Remove 移除一个Endpoint，已经交给它但发送失败的message交给fail处理
+func (d *Dispatcher) Remove(ep Endpoint) {
+	id := ep.GetID()
+	d.Lock()
+	if dp := d.peers[id]; dp != nil {
+		delete(d.peers, id)
+		d.dirty = true
+		d.wakeup()
+		//让等待新message的发送goroutine马上退出
+		select {
+		case dp.kick <- struct{}{}:
+		default:
+		}
+	}
+	d.Unlock()
+}
+
+//Send 把message交给一个队列未满的Endpoint发送，所有Endpoint都满时阻塞
+//返回选中的Endpoint；cq关闭时返回nil，message仍归调用方所有
+func (d *Dispatcher) Send(m *Message, cq <-chan struct{}) Endpoint {
+	return d.dispatch(m, cq, func() *dispatchPeer {
+		return d.pick(nil)
+	})
+}
+
+//SendExcept 和Send一样，但尽量避开skip返回true的Endpoint，例如请求已经超时过的peer
+//只有当所有已连接的peer都被避开时，才会使用被避开的Endpoint
+func (d *Dispatcher) SendExcept(m *Message, skip func(Endpoint) bool, cq <-chan struct{}) Endpoint {
+	return d.dispatch(m, cq, func() *dispatchPeer {
+		return d.pick(skip)
+	})
+}
+
+//SendTo 把message交给指定的Endpoint发送，它的队列满时阻塞等待
+//该Endpoint不存在、已经移除或者cq关闭时返回false，message仍归调用方所有
+func (d *Dispatcher) SendTo(m *Message, id uint32, cq <-chan struct{}) bool {
+	for {
+		d.Lock()
+		dp := d.peers[id]
+		if dp == nil {
+			d.Unlock()
+			return false
+		}
+		if !dp.full() {
+			d.assign(dp, m)
+			d.Unlock()
+			return true
+		}
+		wake := d.wake
+		d.wait++
+		d.Unlock()
+
+		select {
+		case <-wake:
+		case <-cq:
+		}
+		d.Lock()
+		d.wait--
+		d.Unlock()
+
+		select {
+		case <-cq:
+			return false
+		default:
+		}
+	}
+}
+
+//Len 返回Endpoint的数量
+func (d *Dispatcher) Len() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.peers)
+}
+
+//TrySendExcept 把message交给一个skip返回false、队列未满的Endpoint，不阻塞
+//没有这样的Endpoint时返回nil，message仍归调用方所有
+func (d *Dispatcher) TrySendExcept(m *Message, skip func(Endpoint) bool) Endpoint {
+	d.Lock()
+	defer d.Unlock()
+	dp := d.pick(skip)
+	if dp == nil || skip(dp.ep) {
+		return nil
+	}
+	d.assign(dp, m)
+	return dp.ep
+}
+
+//Eject 熔断一个Endpoint，在dur时间内不再给它分配message
+//只有当所有已连接的peer都被熔断时，才会继续使用被熔断的Endpoint
+func (d *Dispatcher) Eject(ep Endpoint, dur time.Duration) {
+	d.Lock()
+	if dp := d.peers[ep.GetID()]; dp != nil {
+		dp.until = time.Now().Add(dur)
+		//熔断结束时唤醒等待方，让它们重新选择
+		time.AfterFunc(dur, func() {
+			d.Lock()
+			d.wakeup()
+			d.Unlock()
+		})
+	}
+	d.Unlock()
+}
+
+//SendKey 按key把message交给一致性哈希环上对应的Endpoint，同一个key总是落在同一个peer上
+//message排在该Endpoint的队列中按顺序发送，不影响其它key；只有它排队的message达到keyQLen时才阻塞等待
+//peer加入或离开时只有少量key会改变归属。环上的位置由pipe ID决定，peer断开重连后是一个新的pipe，
+//它原来拥有的key会分散到其它peer，重连后又按新的位置重新分配
+//返回值与Send相同
+func (d *Dispatcher) SendKey(m *Message, key []byte, cq <-chan struct{}) Endpoint {
+	h := hashKey(key)
+	return d.dispatch(m, cq, func() *dispatchPeer {
+		if dp := d.lookup(h); dp != nil && !dp.dead && len(dp.q) < keyQLen {
+			return dp
+		}
+		return nil
+	})
+}
+
+//dispatch 等待choose选出一个队列未满的Endpoint，然后把message交给它
+//choose在持有锁时调用，返回nil表示需要等待
+func (d *Dispatcher) dispatch(m *Message, cq <-chan struct{}, choose func() *dispatchPeer) Endpoint {
+	for {
+		d.Lock()
+		if dp := choose(); dp != nil {
+			d.assign(dp, m)
+			d.Unlock()
+			return dp.ep
+		}
+		wake := d.wake
+		d.wait++
+		d.Unlock()
+
+		select {
+		case <-wake:
+		case <-cq:
+		}
+		d.Lock()
+		d.wait--
+		d.Unlock()
+
+		select {
+		case <-cq:
+			return nil
+		default:
+		}
+	}
+}
+
+//assign 把message放入Endpoint的队列，调用方必须持有锁
+//Endpoint没有发送goroutine时启动一个，否则由它接着发送
+func (d *Dispatcher) assign(dp *dispatchPeer, m *Message) {
+	d.seq++
+	dp.last = d.seq
+	d.w.Add()
+	dp.bytes += len(m.Header) + len(m.Body)
+	dp.q = append(dp.q, m)
+	if !dp.running {
+		dp.running = true
+		go d.deliver(dp)
+		return
+	}
+	select {
+	case dp.kick <- struct{}{}:
+	default:
+	}
+}
+
+//Drain 等待已经交给Endpoint的message发送完成，最多等到expire
+func (d *Dispatcher) Drain(expire time.Time) {
+	d.w.WaitAbsTimeout(expire)
+}
+
+//pick 选择优先级最高、队列未满的Endpoint，同一优先级选最久未使用的，调用方必须持有锁
+//Endpoint按可用程度分级：正常、被skip避开、被熔断、两者都有。只在所有已连接的peer中
+//最好的那一级里选择，这一级的peer队列都满时返回nil等待，而不是退而使用更差的peer
+func (d *Dispatcher) pick(skip func(Endpoint) bool) *dispatchPeer {
+	now := time.Now()
+	level := func(dp *dispatchPeer) int {
+		l := 0
+		if skip != nil && skip(dp.ep) {
+			l++
+		}
+		if now.Before(dp.until) {
+			l += 2
+		}
+		return l
+	}
+
+	var best *dispatchPeer
+	bestLevel := 4
+	for _, dp := range d.peers {
+		l := level(dp)
+		if l < bestLevel {
+			bestLevel = l
+			best = nil
+		}
+		if l > bestLevel || dp.full() {
+			continue
+		}
+		if best == nil || dp.prio < best.prio ||
+			(dp.prio == best.prio && dp.last < best.last) {
+			best = dp
+		}
+	}
+	return best
+}
+
+//lookup 返回哈希环上h之后的第一个Endpoint，调用方必须持有锁
+func (d *Dispatcher) lookup(h uint32) *dispatchPeer {
+	if d.dirty {
+		d.rebuild()
+	}
+	if len(d.ring) == 0 {
+		return nil
+	}
+	i := sort.Search(len(d.ring), func(i int) bool {
+		return d.ring[i].hash >= h
+	})
+	if i == len(d.ring) {
+		i = 0
+	}
+	return d.ring[i].peer
+}
+
+//rebuild 重建一致性哈希环，调用方必须持有锁
+func (d *Dispatcher) rebuild() {
+	d.ring = d.ring[:0]
+	var b [8]byte
+	for id, dp := range d.peers {
+		binary.BigEndian.PutUint32(b[:4], id)
+		for i := 0; i < ringReplicas; i++ {
+			binary.BigEndian.PutUint32(b[4:], uint32(i))
+			d.ring = append(d.ring, ringPoint{hash: hashKey(b[:]), peer: dp})
+		}
+	}
+	sort.Slice(d.ring, func(i, j int) bool {
+		return d.ring[i].hash < d.ring[j].hash
+	})
+	d.dirty = false
+}
+
+//hashKey 计算key的哈希值，FNV-1a之后再做一次混合，使短key也能均匀分布在环上
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	v := h.Sum32()
+	v ^= v >> 16
+	v *= 0x85ebca6b
+	v ^= v >> 13
+	v *= 0xc2b2ae35
+	v ^= v >> 16
+	return v
+}
+
+//wakeup 唤醒等待Endpoint队列空间的调用方，调用方必须持有锁
+func (d *Dispatcher) wakeup() {
+	if d.wait > 0 {
+		close(d.wake)
+		d.wake = make(chan struct{})
+	}
+}
+
+func (d *Dispatcher) failed(ep Endpoint, m *Message) {
+	if d.fail != nil {
+		d.fail(ep, m)
+	} else {
+		m.Free()
+	}
+	d.w.Done()
+}
+
+//deliver 依次发送dp队列中的message，队列空了drainLinger之后退出
+//发送失败时队列中的message都交给fail处理，dp不再分配message，直到它被Remove
+func (d *Dispatcher) deliver(dp *dispatchPeer) {
+	var linger *time.Timer
+	for {
+		d.Lock()
+		if len(dp.q) == 0 {
+			if dp.dead || d.peers[dp.ep.GetID()] != dp {
+				dp.running = false
+				d.Unlock()
+				return
+			}
+			d.Unlock()
+			if linger == nil {
+				linger = time.NewTimer(drainLinger)
+			} else {
+				linger.Reset(drainLinger)
+			}
+			select {
+			case <-dp.kick:
+				if !linger.Stop() {
+					<-linger.C
+				}
+				continue
+			case <-linger.C:
+			}
+			d.Lock()
+			if len(dp.q) == 0 {
+				dp.running = false
+				d.Unlock()
+				return
+			}
+		}
+		m := dp.q[0]
+		dp.q[0] = nil
+		dp.q = dp.q[1:]
+		d.Unlock()
+
+		n := len(m.Header) + len(m.Body)
+		if dp.ep.SendMsg(m) != nil {
+			d.Lock()
+			dp.dead = true
+			q := dp.q
+			dp.q = nil
+			dp.running = false
+			d.Unlock()
+			d.failed(dp.ep, m)
+			for _, m := range q {
+				d.failed(dp.ep, m)
+			}
+			return
+		}
+		d.Lock()
+		dp.bytes -= n
+		d.wakeup()
+		d.Unlock()
+		d.w.Done()
+	}
+}
@@ -0,0 +1,137 @@
+package pikago_test
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k4s/pikago"
+	"github.com/k4s/pikago/protocol/pull"
+	"github.com/k4s/pikago/protocol/push"
+)
+
+// prioPair returns a push socket dialed to two pull sockets, hi at send
+// priority 1 and lo at 16.
+func prioPair(t *testing.T) (ps, hi, lo pikago.Socket) {
+	ps = newSocket(t, push.NewSocket)
+	hi = newSocket(t, pull.NewSocket)
+	lo = newSocket(t, pull.NewSocket)
+	var adds int32
+	for _, x := range []struct {
+		s    pikago.Socket
+		prio int
+	}{{lo, 16}, {hi, 1}} {
+		addr := listen(t, x.s, &adds)
+		opts := map[string]interface{}{pikago.OptionSendPriority: x.prio}
+		if err := ps.DialOptions(addr, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitAdds(t, &adds, 2)
+	time.Sleep(50 * time.Millisecond) // let the push side add both pipes
+	return ps, hi, lo
+}
+
+// count receives from s in the background and counts the messages.
+func count(s pikago.Socket, n *int32) {
+	go func() {
+		for {
+			if _, err := s.Recv(); err != nil {
+				return
+			}
+			atomic.AddInt32(n, 1)
+		}
+	}()
+}
+
+// waitCount waits until the counts add up to want.
+func waitCount(t *testing.T, want int32, ns ...*int32) {
+	for i := 0; ; i++ {
+		var got int32
+		for _, n := range ns {
+			got += atomic.LoadInt32(n)
+		}
+		if got == want {
+			return
+		}
+		if i == 1000 {
+			t.Fatalf("received %d of %d", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A burst that fits in the preferred peer's send queue all goes to it,
+// however the sender and the peer's writer are scheduled.
+func TestSendPriorityBurst(t *testing.T) {
+	ps, hi, lo := prioPair(t)
+	defer ps.Close()
+	defer hi.Close()
+	defer lo.Close()
+	var nh, nl int32
+	count(hi, &nh)
+	count(lo, &nl)
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		if err := ps.Send(make([]byte, 16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCount(t, n, &nh, &nl)
+	if nl != 0 {
+		t.Fatalf("priority 1 got %d, priority 16 got %d", nh, nl)
+	}
+}
+
+// Once the preferred peer stops reading and its queue fills, the rest
+// goes to the lower priority peer.
+func TestSendPriorityOverflow(t *testing.T) {
+	ps, hi, lo := prioPair(t)
+	defer ps.Close()
+	defer hi.Close()
+	defer lo.Close()
+	hi.SetOption(pikago.OptionMaxBufferedBytes, 64*1024)
+	var nh, nl int32
+	count(lo, &nl)
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		if err := ps.Send(make([]byte, 64*1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; atomic.LoadInt32(&nl) == 0; i++ {
+		if i == 1000 {
+			t.Fatal("priority 16 got nothing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	count(hi, &nh)
+	waitCount(t, n, &nh, &nl)
+	if nh == 0 {
+		t.Fatalf("priority 1 got %d, priority 16 got %d", nh, nl)
+	}
+}
+
+// The sending goroutine waits a while for more messages, but exits
+// once the peer stays idle.
+func TestSendIdleExits(t *testing.T) {
+	ps, hi, lo := prioPair(t)
+	defer ps.Close()
+	defer hi.Close()
+	defer lo.Close()
+	var nh int32
+	count(hi, &nh)
+	time.Sleep(10 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if err := ps.Send([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waitCount(t, 10, &nh)
+	settled(t, before)
+}
@@ -28,4 +28,8 @@ var (
 	ErrBadProperty = errors.New("invalid property name")
 	ErrTLSNoConfig = errors.New("missing TLS configuration")
 	ErrTLSNoCert   = errors.New("missing TLS certificates")
+	ErrBadPort     = errors.New("port is not connected to this socket")
+	ErrTooManyHops = errors.New("too many hops")
+
+	ErrRequestFailed = errors.New("request failed after retries")
 )
@@ -0,0 +1,230 @@
+package pikago
+
+import (
+	"sync"
+)
+
+//FairQueue 供PULL、SUB这类从多个peer接收的protocol使用，把各个Endpoint收到的message合并到socket的读队列
+//每个Endpoint有自己的小队列：总是优先交付OptionRecvPriority更高的Endpoint的message，
+//同一优先级的Endpoint按OptionRecvWeight加权轮流交付，每轮每个Endpoint得到weight个配额，
+//因此一个发送很快的peer不会饿死其它peer。Endpoint的队列短暂为空时本轮剩余的配额留到下一轮，
+//最多累积到2*weight，这样接收比应用慢一点的peer也能得到它的份额
+type FairQueue struct {
+	sock  ProtocolSocket
+	peers map[uint32]*fqPeer
+	depth int
+	seq   uint64
+	cur   *fqPeer       // 当前轮到的Endpoint
+	curID uint32        // cur的ID
+	ready chan struct{} // 有新message时通知pump
+	init  sync.Once
+	sync.Mutex
+}
+
+type fqPeer struct {
+	prio    int
+	weight  int
+	credit  int // 还能交付的message数
+	depth   int // 队列长度，不小于2*weight，可以排下累积的配额
+	q       []*Message
+	space   chan struct{} // 队列有空位时通知Put
+	cq      chan struct{} // Endpoint移除时关闭
+	last    uint64
+	removed bool
+}
+
+//Init 初始化FairQueue，depth是每个Endpoint队列的长度，权重大的Endpoint的队列至少是2*weight
+func (f *FairQueue) Init(sock ProtocolSocket, depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	f.sock = sock
+	f.depth = depth
+	f.peers = make(map[uint32]*fqPeer)
+	f.ready = make(chan struct{}, 1)
+}
+
+//Add 添加一个Endpoint，它的优先级和权重取自OptionRecvPriority和OptionRecvWeight
+func (f *FairQueue) Add(ep Endpoint) {
+	//第一个Endpoint加入时socket已经active，读队列不会再改变
+	f.init.Do(func() {
+		go f.pump()
+	})
+
+	prio := defaultPriority
+	if v, err := EndpointOption(ep, OptionRecvPriority); err == nil {
+		prio = v.(int)
+	}
+	weight := defaultWeight
+	if v, err := EndpointOption(ep, OptionRecvWeight); err == nil {
+		weight = v.(int)
+	}
+	depth := f.depth
+	if 2*weight > depth {
+		depth = 2 * weight
+	}
+	fp := &fqPeer{
+		prio:   prio,
+		weight: weight,
+		depth:  depth,
+		space:  make(chan struct{}, 1),
+		cq:     make(chan struct{}),
+	}
+	f.Lock()
+	f.peers[ep.GetID()] = fp
+	f.Unlock()
+}
+
+//Remove 移除一个Endpoint，它已经排队的message仍会交付给应用
+func (f *FairQueue) Remove(ep Endpoint) {
+	id := ep.GetID()
+	f.Lock()
+	if fp := f.peers[id]; fp != nil && !fp.removed {
+		fp.removed = true
+		close(fp.cq)
+		if len(fp.q) == 0 {
+			delete(f.peers, id)
+		}
+	}
+	f.Unlock()
+}
+
+//Put 把Endpoint收到的message放入它的队列，队列满时阻塞，从而对peer形成背压
+//socket关闭或者Endpoint已移除时返回false，message仍归调用方所有
+func (f *FairQueue) Put(ep Endpoint, m *Message) bool {
+	cq := f.sock.CloseChannel()
+	for {
+		f.Lock()
+		fp := f.peers[ep.GetID()]
+		if fp == nil || fp.removed {
+			f.Unlock()
+			return false
+		}
+		if len(fp.q) < fp.depth {
+			fp.q = append(fp.q, m)
+			f.Unlock()
+			f.notify()
+			return true
+		}
+		f.Unlock()
+
+		select {
+		case <-fp.space:
+		case <-fp.cq:
+			return false
+		case <-cq:
+			return false
+		}
+	}
+}
+
+//TryPut 和Put一样，但队列满时不阻塞而是返回false，用于SUB这类尽力交付的protocol
+func (f *FairQueue) TryPut(ep Endpoint, m *Message) bool {
+	f.Lock()
+	fp := f.peers[ep.GetID()]
+	if fp == nil || fp.removed || len(fp.q) >= fp.depth {
+		f.Unlock()
+		return false
+	}
+	fp.q = append(fp.q, m)
+	f.Unlock()
+	f.notify()
+	return true
+}
+
+func (f *FairQueue) notify() {
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+}
+
+//pick 选择优先级最高且有message的Endpoint，调用方必须持有锁
+//当前Endpoint还有配额时继续交付它，否则轮到同一优先级中还有配额、最久未轮到的Endpoint；
+//都没有配额时开始新的一轮，这一优先级的每个Endpoint的配额增加weight
+func (f *FairQueue) pick() (uint32, *fqPeer) {
+	prio := -1
+	for _, fp := range f.peers {
+		if len(fp.q) > 0 && (prio < 0 || fp.prio < prio) {
+			prio = fp.prio
+		}
+	}
+	if prio < 0 {
+		return 0, nil
+	}
+	if cur := f.cur; cur != nil && cur.prio == prio && cur.credit > 0 && len(cur.q) > 0 {
+		cur.credit--
+		return f.curID, cur
+	}
+
+	id, best := f.next(prio)
+	if best == nil {
+		for _, fp := range f.peers {
+			if fp.prio == prio {
+				fp.credit += fp.weight
+				if fp.credit > 2*fp.weight {
+					fp.credit = 2 * fp.weight
+				}
+			}
+		}
+		id, best = f.next(prio)
+	}
+	f.seq++
+	best.last = f.seq
+	best.credit--
+	f.cur, f.curID = best, id
+	return id, best
+}
+
+//next 返回优先级为prio、有message和配额、最久未轮到的Endpoint，调用方必须持有锁
+func (f *FairQueue) next(prio int) (uint32, *fqPeer) {
+	var bestID uint32
+	var best *fqPeer
+	for id, fp := range f.peers {
+		if fp.prio != prio || len(fp.q) == 0 || fp.credit <= 0 {
+			continue
+		}
+		if best == nil || fp.last < best.last {
+			bestID, best = id, fp
+		}
+	}
+	return bestID, best
+}
+
+func (f *FairQueue) pump() {
+	rq := f.sock.RecvChannel()
+	cq := f.sock.CloseChannel()
+
+	for {
+		f.Lock()
+		id, fp := f.pick()
+		if fp == nil {
+			f.Unlock()
+			select {
+			case <-f.ready:
+				continue
+			case <-cq:
+				return
+			}
+		}
+		m := fp.q[0]
+		fp.q[0] = nil
+		fp.q = fp.q[1:]
+		if fp.removed && len(fp.q) == 0 {
+			delete(f.peers, id)
+		}
+		f.Unlock()
+
+		select {
+		case fp.space <- struct{}{}:
+		default:
+		}
+
+		select {
+		case rq <- m:
+		case <-cq:
+			m.Free()
+			return
+		}
+	}
+}
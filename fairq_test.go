@@ -0,0 +1,59 @@
+package pikago_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/k4s/pikago"
+	"github.com/k4s/pikago/protocol/pull"
+	"github.com/k4s/pikago/protocol/push"
+)
+
+// Two producers that always have messages waiting share the receiver
+// in proportion to their OptionRecvWeight.
+func TestRecvWeightUnderLoad(t *testing.T) {
+	pl := newSocket(t, pull.NewSocket)
+	defer pl.Close()
+	pl.SetOption(pikago.OptionReadQLen, 0)
+	weights := []int{1, 3}
+	for i, w := range weights {
+		l, err := pl.NewListener("tcp://127.0.0.1:0", map[string]interface{}{
+			pikago.OptionRecvWeight: w,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = l.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		ps := newSocket(t, push.NewSocket)
+		defer ps.Close()
+		if err = ps.Dial(l.Address()); err != nil {
+			t.Fatal(err)
+		}
+		go func(b byte) {
+			for ps.Send([]byte{b}) == nil {
+			}
+		}(byte(i))
+	}
+
+	// Let both peers build up a backlog before counting.
+	const n = 4000
+	var got [2]int
+	for i := 0; i < 2*n; i++ {
+		m, err := pl.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= n {
+			got[m[0]]++
+		}
+		// A slow consumer keeps both peers backlogged.
+		for start := time.Now(); time.Since(start) < 50*time.Microsecond; {
+		}
+	}
+	t.Logf("weights %v got %v", weights, got)
+	if r := float64(got[1]) / float64(n); r < 0.65 || r > 0.9 {
+		t.Fatalf("weights %v got %v", weights, got)
+	}
+}
@@ -0,0 +1,89 @@
+package pikago
+
+import "encoding/binary"
+
+//AppendHeaderUint32 在Header末尾追加一个big-endian的uint32，例如收到message的pipe ID
+//Pop和Peek从Header开头读，所以先追加的先被取出
+func (m *Message) AppendHeaderUint32(v uint32) {
+	m.Header = append(m.Header, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+//PopHeaderUint32 移除并返回Header开头的big-endian uint32，例如发送前取出目标pipe ID
+//Header不足4字节时返回ErrTooShort，Header不变
+func (m *Message) PopHeaderUint32() (uint32, error) {
+	v, err := m.PeekHeaderUint32()
+	if err == nil {
+		m.Header = m.Header[4:]
+	}
+	return v, err
+}
+
+//PeekHeaderUint32 返回Header开头的big-endian uint32，但不移除
+//Header不足4字节时返回ErrTooShort
+func (m *Message) PeekHeaderUint32() (uint32, error) {
+	if len(m.Header) < 4 {
+		return 0, ErrTooShort
+	}
+	return binary.BigEndian.Uint32(m.Header), nil
+}
+
+//Backtrace 是REQ/REP和SURVEYOR/RESPONDENT的message经过的路径，由big-endian的uint32组成：
+//前面是沿途每个REP、RESPONDENT收到它的pipe ID，最后是最高位为1的请求ID或survey ID
+//raw模式的REP、RESPONDENT收到的message的Header就是一个Backtrace，第一个是收到它的pipe ID
+type Backtrace []byte
+
+//idFlag 是请求ID的最高位，用来标记Backtrace的结尾
+const idFlag = 0x80000000
+
+//SplitBacktrace 从body开头读出一个Backtrace，直到最高位为1的请求ID，返回它和剩余的body
+//超过max个uint32时返回ErrTooManyHops，没有请求ID时返回ErrGarbled
+func SplitBacktrace(body []byte, max int) (Backtrace, []byte, error) {
+	for n := 4; ; n += 4 {
+		if n > max*4 {
+			return nil, body, ErrTooManyHops
+		}
+		if n > len(body) {
+			return nil, body, ErrGarbled
+		}
+		if body[n-4]&0x80 != 0 {
+			return Backtrace(body[:n]), body[n:], nil
+		}
+	}
+}
+
+//Len 返回Backtrace中uint32的个数
+func (b Backtrace) Len() int {
+	return len(b) / 4
+}
+
+//At 返回第i个uint32
+func (b Backtrace) At(i int) uint32 {
+	return binary.BigEndian.Uint32(b[i*4:])
+}
+
+//Each 从前往后对每个uint32调用fn，fn返回false时停止
+func (b Backtrace) Each(fn func(v uint32) bool) {
+	for i := 0; i < b.Len(); i++ {
+		if !fn(b.At(i)) {
+			return
+		}
+	}
+}
+
+//Hops 返回请求ID之前pipe ID的个数，也就是经过的REP、RESPONDENT和device的数量
+func (b Backtrace) Hops() int {
+	if _, ok := b.Last(); ok {
+		return b.Len() - 1
+	}
+	return b.Len()
+}
+
+//Last 返回最后一个uint32，也就是请求ID或survey ID
+//Backtrace为空或者最后一个不是请求ID(最高位不为1)时返回false
+func (b Backtrace) Last() (uint32, bool) {
+	if b.Len() == 0 {
+		return 0, false
+	}
+	v := b.At(b.Len() - 1)
+	return v, v&idFlag != 0
+}
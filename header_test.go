@@ -0,0 +1,25 @@
+package pikago
+
+import "testing"
+
+func TestHeaderUint32Order(t *testing.T) {
+	m := &Message{}
+	for _, v := range []uint32{1, 0x01020304, 0x80000003} {
+		m.AppendHeaderUint32(v)
+	}
+	if string(m.Header) != "\x00\x00\x00\x01\x01\x02\x03\x04\x80\x00\x00\x03" {
+		t.Fatalf("header %x", m.Header)
+	}
+	for _, want := range []uint32{1, 0x01020304, 0x80000003} {
+		if v, err := m.PeekHeaderUint32(); err != nil || v != want {
+			t.Fatalf("peek %x, %v, want %x", v, err, want)
+		}
+		if v, err := m.PopHeaderUint32(); err != nil || v != want {
+			t.Fatalf("pop %x, %v, want %x", v, err, want)
+		}
+	}
+	m.Header = []byte{1, 2, 3}
+	if _, err := m.PopHeaderUint32(); err != ErrTooShort || len(m.Header) != 3 {
+		t.Fatalf("short header: %v, %d bytes left", err, len(m.Header))
+	}
+}
@@ -1,6 +1,7 @@
 package pikago
 
 import (
+	"hash/crc32"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,95 +14,153 @@ type Message struct {
 	Header []byte
 	Body   []byte
 	Port   Port
+	target Endpoint // Socket.SendTo指定的Endpoint
 	bbuf   []byte
 	hbuf   []byte
-	bsize  int
+	alloc  Allocator // 分配bbuf的Allocator
 	refcnt int32
 	expire time.Time
-	pool   *sync.Pool
+
+	budget  *byteBudget // 占用的socket字节预算，未占用时为nil
+	bcharge int         // 占用的字节数
+
+	sum uint64 // 调试模式下共享时内容的校验和，最高位表示有效
 }
 
-type msgCacheInfo struct {
-	maxbody int
-	pool    *sync.Pool
+//msgDebug 不为0时开启message调试模式，见SetMessageDebug
+var msgDebug int32
+
+//SetMessageDebug 开启或关闭message调试模式，用于查找protocol和应用中的message误用
+//开启后，修改被Dup共享的message、以及Free之后继续使用message会panic；
+//共享的message在Dup、Free、Writable和发送时检查内容是否被修改。
+//调试模式下释放的message不会放回缓存，性能较差，只应该在测试中使用。
+func SetMessageDebug(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&msgDebug, v)
 }
 
-func newMsg(sz int) *Message {
-	m := &Message{}
-	m.bbuf = make([]byte, 0, sz)
-	m.hbuf = make([]byte, 0, 32)
-	m.bsize = sz
-	return m
+func debugging() bool {
+	return atomic.LoadInt32(&msgDebug) != 0
+}
+
+const sumValid = 1 << 63
+
+func (m *Message) checksum() uint64 {
+	h := crc32.NewIEEE()
+	h.Write(m.Header)
+	h.Write(m.Body)
+	return uint64(h.Sum32()) | uint64(len(m.Header))<<32 | sumValid
+}
+
+//check 在调试模式下检查message没有被释放，共享时没有被修改
+func (m *Message) check(op string) {
+	if atomic.LoadInt32(&m.refcnt) <= 0 {
+		panic("pikago: " + op + " of message after Free")
+	}
+	if sum := atomic.LoadUint64(&m.sum); sum != 0 && sum != m.checksum() {
+		panic("pikago: shared message was modified before " + op)
+	}
 }
 
-// 按size切割多个Message的池
-var messageCache = []msgCacheInfo{
-	{
-		maxbody: 64,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(64) },
-		},
-	}, {
-		maxbody: 128,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(128) },
-		},
-	}, {
-		maxbody: 256,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(256) },
-		},
-	}, {
-		maxbody: 512,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(512) },
-		},
-	}, {
-		maxbody: 1024,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(1024) },
-		},
-	}, {
-		maxbody: 4096,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(4096) },
-		},
-	}, {
-		maxbody: 8192,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(8192) },
-		},
-	}, {
-		maxbody: 65536,
-		pool: &sync.Pool{
-			New: func() interface{} { return newMsg(65536) },
-		},
+//msgPool 缓存Message本身，Body的内存由Allocator管理
+var msgPool = sync.Pool{
+	New: func() interface{} {
+		return &Message{hbuf: make([]byte, 0, 32)}
 	},
 }
 
 //Free 在message上减少引用计数，如果没有进一步的引用，则释放它的资源
 //这样做可以让资源在不使用GC的情况下被回收。这对性能有相当大的好处。
 func (m *Message) Free() {
+	debug := debugging()
+	if debug {
+		m.check("Free")
+	}
 	if v := atomic.AddInt32(&m.refcnt, -1); v > 0 {
+		if v == 1 && debug {
+			//只剩一个引用，持有者又可以修改它了
+			atomic.StoreUint64(&m.sum, 0)
+		}
 		return
 	}
-	for i := range messageCache {
-		if m.bsize == messageCache[i].maxbody {
-			messageCache[i].pool.Put(m)
-			return
-		}
+	m.uncharge()
+	if debug {
+		//不放回缓存，之后的使用可以被发现
+		return
+	}
+	//不是由AllocMessage创建的message(例如&Message{Body: b})没有要归还的内存
+	if m.alloc != nil {
+		m.alloc.Free(m.bbuf)
+	}
+	m.bbuf = nil
+	m.alloc = nil
+	m.Body = nil
+	m.Header = nil
+	m.Port = nil
+	m.target = nil
+	msgPool.Put(m)
+}
+
+//uncharge 归还message占用的socket字节预算
+//message离开socket(交给应用或者被释放)时调用
+func (m *Message) uncharge() {
+	if b := m.budget; b != nil {
+		m.budget = nil
+		b.release(m.bcharge)
 	}
 }
 
 //Dup创建了一个“duplicate”的message,它真正做的只是增加消息上的引用计数
-// 请注意，由于底层message实际上是共享的，因此使用者必须注意不要修改消息。
-//(未来修改这个API添加copy-on-write,但现在修改既不需要,也不支持。)
+//由于底层message实际上是共享的，持有者不能直接修改它，需要修改时先调用Writable得到自己的副本。
 //应用程序应该不使用这个函数,它是用于协议,仅Transport和内部使用。
 func (m *Message) Dup() *Message {
+	if debugging() {
+		m.check("Dup")
+		atomic.StoreUint64(&m.sum, m.checksum())
+	}
 	atomic.AddInt32(&m.refcnt, 1)
 	return m
 }
 
+//Writable 返回一个可以修改的message，用法是m = m.Writable()
+//没有被共享时返回m本身；被Dup共享时复制Header和Body，释放调用方持有的引用并返回副本(copy-on-write)
+func (m *Message) Writable() *Message {
+	if debugging() {
+		m.check("Writable")
+	}
+	if !m.shared() {
+		return m
+	}
+	c := m.clone()
+	m.Free()
+	return c
+}
+
+//shared 判断message是否被Dup共享
+func (m *Message) shared() bool {
+	return atomic.LoadInt32(&m.refcnt) > 1
+}
+
+//clone 复制message的内容，不改变m的引用计数
+func (m *Message) clone() *Message {
+	c := AllocMessage(m.alloc, len(m.Body))
+	c.Header = append(c.Header, m.Header...)
+	c.Body = append(c.Body, m.Body...)
+	c.Port = m.Port
+	c.target = m.target
+	c.expire = m.expire
+	return c
+}
+
+//Target 返回Socket.SendTo指定的Endpoint，message由SendMsg发送时返回nil
+//protocol用它把message只发给该Endpoint
+func (m *Message) Target() Endpoint {
+	return m.target
+}
+
 //如果返回ture说明message已“expired”
 //这是由transport实现用来丢弃在写队列中停留太长时间的消息，应该丢弃而不是通过transport传递
 //这只是用于TX路径,是毫无意义的“expiration”Rw路径
@@ -116,20 +175,26 @@ func (m *Message) Expired() bool {
 }
 
 //NewMessage是获得新Message的方式
-//这就使用了一个“cache”，它极大地减少了垃圾收集器的负载
+//Body的内存来自全局的Allocator(见SetAllocator)，它极大地减少了垃圾收集器的负载
 func NewMessage(sz int) *Message {
-	var m *Message
-	for i := range messageCache {
-		if sz < messageCache[i].maxbody {
-			m = messageCache[i].pool.Get().(*Message)
-			break
-		}
-	}
-	if m == nil {
-		m = newMsg(sz)
+	return AllocMessage(nil, sz)
+}
+
+//AllocMessage 和NewMessage一样，但Body的内存来自a，a为nil时使用全局的Allocator
+//message释放时内存归还给a
+func AllocMessage(a Allocator, sz int) *Message {
+	if a == nil {
+		a = GetAllocator()
 	}
+	m := msgPool.Get().(*Message)
+	m.alloc = a
+	m.bbuf = a.Alloc(sz)
 
 	m.refcnt = 1
+	m.sum = 0
+	m.budget = nil
+	m.Port = nil
+	m.target = nil
 	m.Body = m.bbuf
 	m.Header = m.hbuf
 	return m
@@ -0,0 +1,19 @@
+package pikago
+
+import "testing"
+
+func TestFreeLiteralMessage(t *testing.T) {
+	(&Message{Body: []byte("body")}).Free()
+	(&Message{Header: []byte("hdr"), Body: []byte("body")}).Free()
+
+	// Messages put back in the cache this way are reused normally.
+	for i := 0; i < 4; i++ {
+		m := NewMessage(8)
+		m.Header = append(m.Header, "hdr"...)
+		m.Body = append(m.Body, "body"...)
+		if string(m.Header) != "hdr" || string(m.Body) != "body" {
+			t.Fatalf("header %q body %q", m.Header, m.Body)
+		}
+		m.Free()
+	}
+}
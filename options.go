@@ -104,4 +104,187 @@ const (
 	//如果此选项设置,没有阻止,而是默默地消息将被丢弃
 	//值是一个布尔值，默认值为False。
 	OptionBestEffort = "BEST-EFFORT"
+
+	//OptionMaxBufferedBytes 分别限制一个socket上接收和发送方向排队message的字节数，
+	//包括socket的读写队列以及protocol内部每个peer的队列。两个方向各自计算，应用不读取message不会阻塞发送。
+	//接收方向满额时pipe停止从transport读取，从而对peer形成背压；发送方向满额时写操作会像写队列满时一样阻塞，
+	//遵循OptionSendDeadline和OptionBestEffort。message交给应用或者被释放时归还预算。
+	//值是一个int，0表示不限制。默认是0。
+	OptionMaxBufferedBytes = "MAX-BUFFERED-BYTES"
+
+	//OptionBufferedBytes 是只读选项，返回当前socket上两个方向排队message占用的字节数之和。
+	//值是一个int。
+	OptionBufferedBytes = "BUFFERED-BYTES"
+
+	//OptionSendPriority 设置Port的发送优先级，对应nanomsg的NN_SNDPRIO。
+	//用于PUSH和REQ这类负载均衡的协议：只有当所有优先级更高的peer的发送队列都满了或者断开时，
+	//优先级更低的peer才会收到message，同一优先级的peer轮流发送。
+	//可以在dialer或listener上设置，也可以在socket上设置作为默认值。
+	//值是一个int，取值1(最高)到16(最低)，默认是8。
+	OptionSendPriority = "SEND-PRIORITY"
+
+	//OptionRecvPriority 设置Port的接收优先级，对应nanomsg的NN_RCVPRIO。
+	//用于PULL这类从多个peer公平接收的协议：优先级更高的peer有待接收的message时，
+	//优先级更低的peer的message不会被交给应用。
+	//可以在dialer或listener上设置，也可以在socket上设置作为默认值。
+	//值是一个int，取值1(最高)到16(最低)，默认是8。
+	OptionRecvPriority = "RECV-PRIORITY"
+
+	//OptionRecvWeight 设置Port的接收权重。
+	//PULL、SUB、REP和RESPONDENT在同一接收优先级的peer之间加权轮流交付message，
+	//每轮最多连续交付权重个来自同一个peer的message，因此一个繁忙的peer不会淹没其它peer。
+	//可以在dialer或listener上设置，也可以在socket上设置作为默认值。
+	//值是一个int，必须大于0，默认是1。
+	OptionRecvWeight = "RECV-WEIGHT"
+
+	//OptionRouteKey 用于PUSH，按message的key做粘性路由。
+	//值是一个KeyFunc(或者func(*Message) []byte)，从message中提取key，例如一个实体ID。
+	//带key的message通过一致性哈希发送给已连接的某个PULL peer，同一个key总是落在同一个peer上，
+	//该peer忙碌时排在它的队列中而不是换一个peer，其它key不受影响；peer加入或离开时只有少量key会改变归属。
+	//归属按连接计算，peer断开重连后它原来的key会重新分配，不一定回到它那里。
+	//KeyFunc返回nil的message仍按OptionSendPriority负载均衡。值为nil时关闭，默认关闭。
+	OptionRouteKey = "ROUTE-KEY"
+
+	//OptionMaxRetries 用于REQ，限制一个请求按OptionRetryTime重发的次数。
+	//重发次数用完仍没有回复时，请求失败，Recv返回ErrRequestFailed。
+	//重发时优先选择还没有发送过该请求的peer。值是一个int，0表示不限制，默认是0。
+	OptionMaxRetries = "MAX-RETRIES"
+
+	//OptionEjectThreshold 用于REQ，一个peer连续请求超时达到这个次数时被熔断，
+	//在OptionEjectTime时间内不再给它发送请求；收到它的回复会清零计数。
+	//所有peer都被熔断时仍会使用它们。值是一个int，0表示不熔断，默认是0。
+	OptionEjectThreshold = "EJECT-THRESHOLD"
+
+	//OptionEjectTime 用于REQ，是被熔断的peer不再收到请求的时长。
+	//值是一个time.Duration，默认是30秒。
+	OptionEjectTime = "EJECT-TIME"
+
+	//OptionHedgeDelay 用于REQ，开启对冲请求：请求发出后这么久仍没有回复时，
+	//把同一个请求再发给另一个空闲的peer，返回先到的回复，晚到的回复被丢弃。
+	//没有其它空闲peer时不对冲。值是一个time.Duration，0表示关闭，默认关闭。
+	OptionHedgeDelay = "HEDGE-DELAY"
+
+	//OptionHedgesSent 是REQ上的只读选项，返回已经发出的对冲请求数。值是一个int。
+	OptionHedgesSent = "HEDGES-SENT"
+
+	//OptionHedgesWon 是REQ上的只读选项，返回对冲的peer先回复的次数。值是一个int。
+	OptionHedgesWon = "HEDGES-WON"
+
+	//OptionReplyCacheSize 用于REP，开启幂等回复缓存并设置最多缓存的请求数。
+	//REQ超时后会用同一个请求ID重发请求，开启后REP按pipe ID和请求ID记住最近的回复，
+	//重复的请求直接得到缓存的回复而不会再交给应用；应用还在处理的请求，其重复请求被丢弃，最多丢弃30秒，
+	//应用没有回复就接收下一个请求时立即停止丢弃，这样应用放弃的请求在REQ重发时还能再交给应用。
+	//超出数量时淘汰最久未使用的请求。值是一个int，0表示关闭，默认关闭。
+	OptionReplyCacheSize = "REPLY-CACHE-SIZE"
+
+	//OptionReplyCacheTTL 用于REP，是回复缓存中请求保留的时长，应该比REQ的OptionRetryTime长。
+	//值是一个time.Duration，默认是2分钟。
+	OptionReplyCacheTTL = "REPLY-CACHE-TTL"
+
+	//OptionSubscribePattern 用于SUB，按topic模式订阅。值是[]byte或string。
+	//topic是message body中第一个空白或控制字符(<= 0x20)之前的部分，按OptionTopicSeparator分成若干段，
+	//模式中的"*"匹配一段，"#"匹配零段或多段，例如"orders.*.eu"、"metrics.#"。可以和OptionSubscribe同时使用。
+	OptionSubscribePattern = "SUBSCRIBE-PATTERN"
+
+	//OptionUnsubscribePattern 用于SUB，删除先前用OptionSubscribePattern建立的订阅。
+	OptionUnsubscribePattern = "UNSUBSCRIBE-PATTERN"
+
+	//OptionSubscribeRegexp 用于SUB，用正则表达式匹配topic来订阅，语法同regexp包，需要时自行加上^和$。
+	//值是[]byte或string，表达式无效时返回ErrBadValue。
+	OptionSubscribeRegexp = "SUBSCRIBE-REGEXP"
+
+	//OptionUnsubscribeRegexp 用于SUB，删除先前用OptionSubscribeRegexp建立的订阅。
+	OptionUnsubscribeRegexp = "UNSUBSCRIBE-REGEXP"
+
+	//OptionTopicSeparator 用于SUB，是topic模式中分隔段的字节。值是byte或者长度为1的string，默认是"."。
+	//topic在空白或控制字符处结束，因此不能使用小于等于0x20的字节，否则返回ErrBadValue。
+	OptionTopicSeparator = "TOPIC-SEPARATOR"
+
+	//OptionSubscriptions 是SUB上的只读选项，返回当前生效的所有订阅，值是[]sub.Subscription。
+	OptionSubscriptions = "SUBSCRIPTIONS"
+
+	//OptionConflate 用于SUB，开启按topic合并。应用处理不过来时，每个topic只保留最新的一条未交付message，
+	//不同topic按最早的未交付message到达的顺序交付。topic默认是匹配到的最长订阅前缀，
+	//只匹配空前缀(订阅全部)时和模式、正则订阅一样是message的topic，也可以用OptionConflateKey指定。
+	//已经进入读队列的message不再合并，需要时可以把OptionReadQLen设为0。值是一个bool，默认关闭。
+	OptionConflate = "CONFLATE"
+
+	//OptionConflateKey 用于SUB，是合并时使用的key。值是一个KeyFunc(或者func(*Message) []byte)，
+	//返回nil时使用默认的key。值为nil时使用默认的key，默认为nil。
+	OptionConflateKey = "CONFLATE-KEY"
+
+	//OptionSlowConsumerPolicy 用于PUB，决定某个peer的发送队列满时怎么处理新message。
+	//值是pub包中的一个策略常量：pub.DropNewest丢弃新message(默认)，pub.DropOldest丢弃队列中最旧的message，
+	//pub.Block最多等待OptionSlowConsumerTimeout后再丢弃，pub.Disconnect丢弃并在累计丢弃
+	//OptionSlowConsumerLimit个message后断开该peer。每个peer丢弃的数量可以通过Port的PropDropped查询。
+	OptionSlowConsumerPolicy = "SLOW-CONSUMER-POLICY"
+
+	//OptionSlowConsumerTimeout 用于PUB的pub.Block策略，是一次发布最多等待慢peer的时间，所有peer共用。
+	//值是一个time.Duration，必须大于0，默认是1秒。
+	OptionSlowConsumerTimeout = "SLOW-CONSUMER-TIMEOUT"
+
+	//OptionSlowConsumerLimit 用于PUB的pub.Disconnect策略，是断开peer之前允许丢弃的message数。
+	//值是一个int，必须大于0，默认是100。
+	OptionSlowConsumerLimit = "SLOW-CONSUMER-LIMIT"
+
+	//OptionPeerQLen 用于PUB，是每个peer发送队列的长度，只影响之后加入的peer。
+	//值是一个int，必须大于0，默认取OptionWriteQLen的值。
+	OptionPeerQLen = "PEER-QLEN"
+
+	//OptionPublisherFilter 用于PUB和SUB，开启发布端过滤。双方都开启时，SUB把订阅发送给PUB，
+	//PUB只把匹配的message发给该peer，从而节省带宽；模式和正则订阅会让PUB发送全部message。
+	//通过握手头的保留字段协商，只有基于流的transport支持，只影响之后建立的连接。
+	//注意旧版本的peer会拒绝保留字段不为0的握手，所有peer升级之后才能开启。值是一个bool，默认关闭。
+	OptionPublisherFilter = "PUBLISHER-FILTER"
+
+	//OptionLastValueCache 用于PUB，开启最新值缓存并设置缓存的message数，用于解决晚加入的订阅者错过之前消息的问题。
+	//新的peer连接时先收到缓存中的message(从旧到新)，然后才是实时的message；开启了OptionPublisherFilter的peer
+	//则在每次订阅时收到与新订阅匹配的缓存message。设置了OptionLastValueKey时每个key只保留最新的一条，
+	//否则保留最近的若干条。值是一个int，0表示关闭，默认关闭。
+	OptionLastValueCache = "LAST-VALUE-CACHE"
+
+	//OptionLastValueKey 用于PUB，是最新值缓存的key。值是一个KeyFunc(或者func(*Message) []byte)，
+	//例如取出message的topic；返回nil的message不缓存。修改时清空缓存。值为nil时按条数缓存，默认为nil。
+	OptionLastValueKey = "LAST-VALUE-KEY"
+
+	//OptionSendWaitForPeer 开启后，没有已连接的peer时Send阻塞等待peer，而不是交给protocol后被丢弃，
+	//最多等待OptionSendDeadline。OptionBestEffort时不等待。值是一个bool，默认关闭。
+	OptionSendWaitForPeer = "SEND-WAIT-FOR-PEER"
+
+	//OptionPolyamorous 用于PAIR v1，开启多peer模式：可以同时连接多个peer，收到的message的Port是发送它的peer，
+	//发送时如果message的Port仍然连接着就发给它(例如直接回复收到的message)，否则发给任意一个peer。
+	//只能在连接peer之前修改，否则返回ErrProtoState。值是一个bool，默认关闭。
+	OptionPolyamorous = "POLYAMOROUS"
+
+	//OptionStealPeer 用于PAIR，开启后新连接的peer替换已有的peer(旧的连接被关闭)，而不是被拒绝，
+	//适合对端重启后旧连接还没有被发现断开的情况。值是一个bool，默认关闭。
+	OptionStealPeer = "STEAL-PEER"
+
+	//OptionOfflineQLen 用于PAIR，是没有peer时最多缓存的message数量，peer连接后按顺序发出。
+	//发送给断开的peer失败的message也会放回缓存。缓存满时message留在发送队列中，Send按OptionSendDeadline阻塞。
+	//值是一个int，默认是0，即只使用发送队列。
+	OptionOfflineQLen = "OFFLINE-QLEN"
+
+	//OptionBusDedup 用于BUS，开启后与同样开启的peer交换的message带有来源socket、序号和跳数，
+	//收到重复的message、自己发出后绕回来的message、或者跳数超过OptionTTL的message都会被丢弃，
+	//使raw BUS device可以用于不是全连接的拓扑。只对之后建立的连接生效。值是一个bool，默认关闭。
+	OptionBusDedup = "BUS-DEDUP"
+
+	//OptionAllocator 设置socket使用的Allocator，用于这个socket的Send和之后建立的TCP、IPC连接接收的message。
+	//值是一个Allocator，例如NewPoolAllocator按需要的分级创建的*PoolAllocator。
+	//为nil时使用全局的Allocator(见SetAllocator)，默认为nil。
+	OptionAllocator = "ALLOCATOR"
+
+	//OptionReadBufferSize 是TCP、IPC等流式连接接收时的缓冲区大小，开启后一次系统调用可以读到多个小message。
+	//只对之后建立的连接生效。值是一个int，0表示不缓冲，默认是0。
+	OptionReadBufferSize = "READ-BUFFER-SIZE"
+
+	//OptionWriteBatchSize 开启TCP、TLS、IPC等流式连接的合并写：protocol发送的message先进入连接的队列，
+	//由连接把排队的多个message合并成一次写，每次最多合并这么多字节，适合高频率的小message。
+	//写失败在之后的发送中返回。只对之后建立的连接生效。值是一个int，0表示关闭，默认关闭；对延迟敏感的socket不应开启。
+	OptionWriteBatchSize = "WRITE-BATCH-SIZE"
+
+	//OptionWriteBatchDelay 用于合并写，队列中不足OptionWriteBatchSize时最多等待更多message的时间，会增加延迟。
+	//值是一个time.Duration，默认是0，即只合并已经在队列中的message。
+	OptionWriteBatchDelay = "WRITE-BATCH-DELAY"
 )
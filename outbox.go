@@ -0,0 +1,112 @@
+package pikago
+
+import (
+	"sync"
+	"time"
+)
+
+//Outbox 是发往一个Endpoint的有界队列，供BUS、REP这类每个peer各自排队发送的protocol使用
+//只有队列中有message时才有一个goroutine在发送，队列空了它就退出，空闲的连接不占用发送goroutine
+type Outbox struct {
+	ep      Endpoint
+	depth   int
+	q       []*Message // q[head:]是排队的message
+	head    int
+	running bool // 有goroutine正在发送
+	closed  bool // 已经关闭或者发送失败
+	sync.Mutex
+}
+
+//NewOutbox 创建一个发往ep、最多排队depth个message的Outbox
+func NewOutbox(ep Endpoint, depth int) *Outbox {
+	if depth < 1 {
+		depth = 1
+	}
+	return &Outbox{ep: ep, depth: depth}
+}
+
+//TryPut 把message放入队列，不阻塞
+//队列已满、Outbox已经关闭或者之前发送失败时返回false，message仍归调用方所有
+func (o *Outbox) TryPut(m *Message) bool {
+	o.Lock()
+	defer o.Unlock()
+	if o.closed || len(o.q)-o.head >= o.depth {
+		return false
+	}
+	if len(o.q) == cap(o.q) && o.head > 0 {
+		//把排队的message移到开头，重用已经发送的部分
+		n := copy(o.q, o.q[o.head:])
+		for i := n; i < len(o.q); i++ {
+			o.q[i] = nil
+		}
+		o.q = o.q[:n]
+		o.head = 0
+	}
+	o.q = append(o.q, m)
+	if !o.running {
+		o.running = true
+		go o.run()
+	}
+	return true
+}
+
+//Len 返回排队还未发送的message数量
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.q) - o.head
+}
+
+//Drain 等待排队的message发送完成，最多等到expire；全部发送完成时返回true
+func (o *Outbox) Drain(expire time.Time) bool {
+	for {
+		o.Lock()
+		idle := !o.running
+		o.Unlock()
+		if idle {
+			return true
+		}
+		dur := time.Until(expire)
+		if dur <= 0 {
+			return false
+		}
+		if dur > time.Millisecond*10 {
+			dur = time.Millisecond * 10
+		}
+		time.Sleep(dur)
+	}
+}
+
+//Close 关闭Outbox并释放还未发送的message，正在发送的message不受影响
+func (o *Outbox) Close() {
+	o.Lock()
+	o.closed = true
+	for _, m := range o.q[o.head:] {
+		m.Free()
+	}
+	o.q = nil
+	o.head = 0
+	o.Unlock()
+}
+
+func (o *Outbox) run() {
+	for {
+		o.Lock()
+		if o.head == len(o.q) {
+			o.q = o.q[:0]
+			o.head = 0
+			o.running = false
+			o.Unlock()
+			return
+		}
+		m := o.q[o.head]
+		o.q[o.head] = nil
+		o.head++
+		o.Unlock()
+
+		if o.ep.SendMsg(m) != nil {
+			m.Free()
+			o.Close()
+		}
+	}
+}
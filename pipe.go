@@ -22,6 +22,9 @@ type pipe struct {
 	d       *dialer
 	sock    *socket
 	closing bool // true if we were closed
+	counted bool // true once the protocol has it, see socket.npeers
+
+	prophook ProtocolPropHook // set before the port hook runs, unlike sock
 
 	sync.Mutex
 }
@@ -76,12 +79,20 @@ func (p *pipe) Close() error {
 	if hook != nil {
 		hook(PortActionRemove, p)
 	}
+	if p.d != nil && sock != nil {
+		p.d.redial()
+	}
 	return nil
 }
 
 func (p *pipe) SendMsg(msg *Message) error {
 
+	if debugging() {
+		msg.check("send")
+	}
 	if err := p.pipe.Send(msg); err != nil {
+		//message已经离开socket的队列，无论protocol释放还是保留它，都不再占用字节预算
+		msg.uncharge()
 		p.Close()
 		return err
 	}
@@ -95,10 +106,34 @@ func (p *pipe) RecvMsg() *Message {
 		p.Close()
 		return nil
 	}
+	//字节预算用完时在这里阻塞，不再从transport读取，从而对peer形成背压
+	if err = p.sock.rbudget.charge(msg, nil, p.closeq, p.sock.closeq); err != nil {
+		msg.Free()
+		p.Close()
+		return nil
+	}
 	msg.Port = p
 	return msg
 }
 
+//GetOption 返回该pipe上的选项，先查找所属dialer或listener，再回退到socket
+func (p *pipe) GetOption(name string) (interface{}, error) {
+	var opts portOptions
+	switch {
+	case p.d != nil:
+		opts = p.d.opts
+	case p.l != nil:
+		opts = p.l.opts
+	}
+	p.sock.Lock()
+	v, err := opts.get(name)
+	p.sock.Unlock()
+	if err != ErrBadOption {
+		return v, err
+	}
+	return p.sock.GetOption(name)
+}
+
 func (p *pipe) Address() string {
 	switch {
 	case p.l != nil:
@@ -110,6 +145,11 @@ func (p *pipe) Address() string {
 }
 
 func (p *pipe) GetProp(name string) (interface{}, error) {
+	if h := p.prophook; h != nil {
+		if v, err := h.PropHook(p, name); err != ErrBadProperty {
+			return v, err
+		}
+	}
 	return p.pipe.GetProp(name)
 }
 
@@ -0,0 +1,52 @@
+package pikago
+
+//默认的发送和接收优先级，与nanomsg相同
+const defaultPriority = 8
+
+//默认的接收权重
+const defaultWeight = 1
+
+//portOptions 保存dialer或listener上由core处理的选项
+//通过它们建立的Port(Endpoint)继承这些选项，未设置的选项回退到socket上的值
+type portOptions map[string]interface{}
+
+func (o portOptions) set(name string, value interface{}) error {
+	switch name {
+	case OptionSendPriority, OptionRecvPriority:
+		if err := checkPriority(value); err != nil {
+			return err
+		}
+		o[name] = value
+		return nil
+	case OptionRecvWeight:
+		if err := checkWeight(value); err != nil {
+			return err
+		}
+		o[name] = value
+		return nil
+	}
+	return ErrBadOption
+}
+
+func (o portOptions) get(name string) (interface{}, error) {
+	if v, ok := o[name]; ok {
+		return v, nil
+	}
+	return nil, ErrBadOption
+}
+
+//checkPriority 检查优先级的取值，有效范围是1(最高)到16(最低)
+func checkPriority(value interface{}) error {
+	if v, ok := value.(int); !ok || v < 1 || v > 16 {
+		return ErrBadValue
+	}
+	return nil
+}
+
+//checkWeight 检查接收权重的取值，必须是正整数
+func checkWeight(value interface{}) error {
+	if v, ok := value.(int); !ok || v < 1 {
+		return ErrBadValue
+	}
+	return nil
+}
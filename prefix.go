@@ -0,0 +1,191 @@
+package pikago
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//PrefixSet 是一组字节前缀，供SUB这类按前缀匹配topic的protocol使用
+//内部是一棵不可变的前缀树：修改时只复制路径上的节点，再原子地替换根节点，
+//因此匹配时不需要加锁，复杂度是O(len(topic))，与前缀的数量无关
+//零值是一个可用的空集合
+type PrefixSet struct {
+	root atomic.Value // *prefixNode
+	size int
+	mu   sync.Mutex // 串行化修改
+}
+
+type prefixNode struct {
+	end  bool          // 从根到这里的路径是集合中的一个前缀
+	keys []byte        // 子节点对应的字节，升序
+	kids []*prefixNode // 与keys一一对应
+}
+
+//child 返回字节c对应的子节点
+func (n *prefixNode) child(c byte) *prefixNode {
+	i, ok := n.find(c)
+	if !ok {
+		return nil
+	}
+	return n.kids[i]
+}
+
+//find 二分查找字节c，返回它的位置或者应该插入的位置
+func (n *prefixNode) find(c byte) (int, bool) {
+	lo, hi := 0, len(n.keys)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if n.keys[mid] < c {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo < len(n.keys) && n.keys[lo] == c
+}
+
+func (n *prefixNode) clone() *prefixNode {
+	if n == nil {
+		return &prefixNode{}
+	}
+	c := &prefixNode{end: n.end}
+	c.keys = append([]byte(nil), n.keys...)
+	c.kids = append([]*prefixNode(nil), n.kids...)
+	return c
+}
+
+//with 返回加入前缀p之后的新节点，n本身不变
+func (n *prefixNode) with(p []byte) *prefixNode {
+	c := n.clone()
+	if len(p) == 0 {
+		c.end = true
+		return c
+	}
+	i, ok := c.find(p[0])
+	if !ok {
+		c.keys = append(c.keys, 0)
+		copy(c.keys[i+1:], c.keys[i:])
+		c.keys[i] = p[0]
+		c.kids = append(c.kids, nil)
+		copy(c.kids[i+1:], c.kids[i:])
+		c.kids[i] = nil
+	}
+	c.kids[i] = c.kids[i].with(p[1:])
+	return c
+}
+
+//without 返回去掉前缀p之后的新节点，节点变空时返回nil，n本身不变
+func (n *prefixNode) without(p []byte) *prefixNode {
+	c := n.clone()
+	if len(p) == 0 {
+		c.end = false
+	} else {
+		i, _ := c.find(p[0])
+		if kid := c.kids[i].without(p[1:]); kid != nil {
+			c.kids[i] = kid
+		} else {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			c.kids = append(c.kids[:i], c.kids[i+1:]...)
+		}
+	}
+	if !c.end && len(c.kids) == 0 {
+		return nil
+	}
+	return c
+}
+
+func (s *PrefixSet) load() *prefixNode {
+	n, _ := s.root.Load().(*prefixNode)
+	return n
+}
+
+//Add 加入一个前缀，已经存在时返回false
+func (s *PrefixSet) Add(p []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root := s.load()
+	if s.contains(root, p) {
+		return false
+	}
+	s.root.Store(root.with(p))
+	s.size++
+	return true
+}
+
+//Remove 移除一个前缀，不存在时返回false
+func (s *PrefixSet) Remove(p []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root := s.load()
+	if !s.contains(root, p) {
+		return false
+	}
+	if root = root.without(p); root == nil {
+		root = &prefixNode{}
+	}
+	s.root.Store(root)
+	s.size--
+	return true
+}
+
+//contains 判断p本身是否在集合中
+func (s *PrefixSet) contains(n *prefixNode, p []byte) bool {
+	for _, c := range p {
+		if n == nil {
+			return false
+		}
+		n = n.child(c)
+	}
+	return n != nil && n.end
+}
+
+//Match 判断集合中是否有b的前缀，不需要加锁
+func (s *PrefixSet) Match(b []byte) bool {
+	return s.Longest(b) >= 0
+}
+
+//Longest 返回集合中b的最长前缀的长度，没有时返回-1，不需要加锁
+func (s *PrefixSet) Longest(b []byte) int {
+	n := s.load()
+	if n == nil {
+		return -1
+	}
+	best := -1
+	if n.end {
+		best = 0
+	}
+	for i, c := range b {
+		if n = n.child(c); n == nil {
+			break
+		}
+		if n.end {
+			best = i + 1
+		}
+	}
+	return best
+}
+
+//Len 返回集合中前缀的数量
+func (s *PrefixSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+//List 返回集合中所有前缀的副本，按字节序排列
+func (s *PrefixSet) List() [][]byte {
+	var out [][]byte
+	var walk func(n *prefixNode, path []byte)
+	walk = func(n *prefixNode, path []byte) {
+		if n.end {
+			out = append(out, append([]byte(nil), path...))
+		}
+		for i, kid := range n.kids {
+			walk(kid, append(path, n.keys[i]))
+		}
+	}
+	if n := s.load(); n != nil {
+		walk(n, nil)
+	}
+	return out
+}
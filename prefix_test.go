@@ -0,0 +1,128 @@
+package pikago
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPrefixSetAddRemove(t *testing.T) {
+	var s PrefixSet
+	for i, c := range []struct {
+		op   string
+		p    string
+		want bool
+		len  int
+	}{
+		{"add", "a/b", true, 1},
+		{"add", "a/b", false, 1},
+		{"add", "a", true, 2},
+		{"add", "", true, 3},
+		{"add", "", false, 3},
+		{"remove", "a/", false, 3},
+		{"remove", "x", false, 3},
+		{"remove", "a", true, 2},
+		{"remove", "a", false, 2},
+		{"remove", "", true, 1},
+		{"remove", "a/b", true, 0},
+		{"remove", "a/b", false, 0},
+		{"add", "a/b", true, 1},
+	} {
+		var got bool
+		if c.op == "add" {
+			got = s.Add([]byte(c.p))
+		} else {
+			got = s.Remove([]byte(c.p))
+		}
+		if got != c.want || s.Len() != c.len {
+			t.Errorf("%d: %s %q = %v, len %d; want %v, len %d",
+				i, c.op, c.p, got, s.Len(), c.want, c.len)
+		}
+	}
+}
+
+func TestPrefixSetLongest(t *testing.T) {
+	var empty PrefixSet
+	if n := empty.Longest([]byte("a")); n != -1 {
+		t.Errorf("empty set: got %d, want -1", n)
+	}
+
+	var s PrefixSet
+	for _, p := range []string{"a", "a/b/", "a/b/c", "x"} {
+		s.Add([]byte(p))
+	}
+	cases := []struct {
+		b    string
+		want int
+	}{
+		{"", -1},
+		{"b", -1},
+		{"/a", -1},
+		{"a", 1},
+		{"a/b", 1},
+		{"a/b/", 4},
+		{"a/b/d", 4},
+		{"a/b/c", 5},
+		{"a/b/cd", 5},
+		{"xyz", 1},
+	}
+	for _, c := range cases {
+		if n := s.Longest([]byte(c.b)); n != c.want {
+			t.Errorf("Longest(%q) = %d, want %d", c.b, n, c.want)
+		}
+		if m := s.Match([]byte(c.b)); m != (c.want >= 0) {
+			t.Errorf("Match(%q) = %v", c.b, m)
+		}
+	}
+
+	// The empty prefix matches everything, with length 0.
+	s.Add(nil)
+	for _, c := range cases {
+		want := c.want
+		if want < 0 {
+			want = 0
+		}
+		if n := s.Longest([]byte(c.b)); n != want {
+			t.Errorf("with empty prefix, Longest(%q) = %d, want %d", c.b, n, want)
+		}
+	}
+}
+
+func TestPrefixSetList(t *testing.T) {
+	var s PrefixSet
+	if l := s.List(); len(l) != 0 {
+		t.Fatalf("empty set: got %q", l)
+	}
+	for _, p := range []string{"b", "a/c", "", "a", "a/b", "\xff", "B"} {
+		s.Add([]byte(p))
+	}
+	s.Remove([]byte("a/c"))
+	var got []string
+	for _, p := range s.List() {
+		got = append(got, string(p))
+	}
+	want := []string{"", "B", "a", "a/b", "b", "\xff"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func BenchmarkPrefixSetLongest(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			var s PrefixSet
+			for i := 0; i < n; i++ {
+				s.Add([]byte(fmt.Sprintf("market/%d/", i)))
+			}
+			hit := []byte(fmt.Sprintf("market/%d/trade/price", n/2))
+			miss := []byte("weather/london/temperature")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if s.Longest(hit) < 0 || s.Longest(miss) >= 0 {
+					b.Fatal("wrong match")
+				}
+			}
+		})
+	}
+}
@@ -22,4 +22,12 @@ const (
 	//PropHTTPRequest传达一个* http.Request
 	//这个属性只存在于websocket连接中。
 	PropHTTPRequest = "HTTP-REQUEST"
+
+	//PropDropped 是PUB因为peer处理太慢而丢弃的发给它的message数，
+	//见OptionSlowConsumerPolicy。值是一个uint64
+	PropDropped = "DROPPED"
+
+	//PropExtensions 是握手时双方都声明的扩展标志，例如ExtPubFilter
+	//只有基于流的transport(tcp、ipc、tls)会协商扩展。值是一个uint16
+	PropExtensions = "EXTENSIONS"
 )
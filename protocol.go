@@ -19,10 +19,27 @@ type Endpoint interface {
 
 	//RecvMsg 接收一个message，当发送错误，pipe将关闭，返回nil
 	RecvMsg() *Message
+
+	//GetProp 返回该Endpoint的属性，例如PropExtensions，见Port.GetProp
+	GetProp(string) (interface{}, error)
+}
+
+//EndpointOptioner 是Endpoint可选实现的接口，用来获取该Endpoint上的选项，例如OptionSendPriority
+//socket交给protocol的Endpoint都实现了它，protocol通过EndpointOption使用
+type EndpointOptioner interface {
+	GetOption(string) (interface{}, error)
+}
+
+//EndpointOption 获取Endpoint上的选项，先查找建立它的dialer或listener，没有设置时返回socket上的值
+//ep没有实现EndpointOptioner时返回ErrBadOption
+func EndpointOption(ep Endpoint, name string) (interface{}, error) {
+	if o, ok := ep.(EndpointOptioner); ok {
+		return o.GetOption(name)
+	}
+	return nil, ErrBadOption
 }
 
 // Protocol 实现protocol 处理接口，每个protocol类型将实现其中一个
-//
 type Protocol interface {
 
 	//Init 由core模块调用，它还将保存一个handle供后面使用
@@ -81,6 +98,30 @@ type ProtocolSendHook interface {
 	SendHook(*Message) bool
 }
 
+//ProtocolPropHook 协议的目的是成为一个额外的扩展接口
+type ProtocolPropHook interface {
+
+	//PropHook 返回protocol为某个Endpoint维护的属性，例如PUB丢弃的message数
+	//Port.GetProp先调用它，返回ErrBadProperty时再查询transport
+	PropHook(ep Endpoint, name string) (interface{}, error)
+}
+
+//ProtocolExtender 协议的目的是成为一个额外的扩展接口
+type ProtocolExtender interface {
+
+	//Extensions 返回握手时向peer声明的扩展标志，例如ExtPubFilter
+	//只有双方都声明的标志才生效，协商结果可以通过PropExtensions查询
+	Extensions() uint16
+}
+
+//ProtocolTargeter 协议的目的是成为一个额外的扩展接口
+type ProtocolTargeter interface {
+
+	//CanSendTo 返回当前模式下是否支持Socket.SendTo
+	//支持时protocol应该把Message.Target()不为nil的message只发给该Endpoint
+	CanSendTo() bool
+}
+
 //ProtocolSocket 是给protocols 和socket通讯的接口
 //Protocol实现不应该访问任何sockets或pipes，除非使用函数作为许可在ProtocolSocket上面
 //注意所有函数列表非阻塞
@@ -119,6 +160,7 @@ type ProtocolSocket interface {
 
 const (
 	ProtoPair       = (1 * 16)
+	ProtoPair1      = (1 * 16) + 1
 	ProtoPub        = (2 * 16)
 	ProtoSub        = (2 * 16) + 1
 	ProtoReq        = (3 * 16)
@@ -139,6 +181,7 @@ const (
 func ProtocolName(number uint16) string {
 	names := map[uint16]string{
 		ProtoPair:       "pair",
+		ProtoPair1:      "pair1",
 		ProtoPub:        "pub",
 		ProtoSub:        "sub",
 		ProtoReq:        "req",
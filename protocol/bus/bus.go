@@ -3,7 +3,6 @@
 package bus
 
 import (
-	"encoding/binary"
 	"sync"
 	"time"
 
@@ -11,17 +10,23 @@ import (
 )
 
 type busEp struct {
-	ep pikago.Endpoint
-	q  chan *pikago.Message
-	x  *bus
+	ep  pikago.Endpoint
+	q   *pikago.Outbox
+	x   *bus
+	ext bool // peer exchanges the extension header
 }
 
 type bus struct {
-	sock  pikago.ProtocolSocket
-	peers map[uint32]*busEp
-	raw   bool
-	w     pikago.Waiter
-	init  sync.Once
+	sock   pikago.ProtocolSocket
+	peers  map[uint32]*busEp
+	raw    bool
+	dedup  bool
+	ttl    int
+	origin uint64
+	seq    uint32
+	seen   seenSet
+	w      pikago.Waiter
+	init   sync.Once
 
 	sync.Mutex
 }
@@ -30,6 +35,8 @@ type bus struct {
 func (x *bus) Init(sock pikago.ProtocolSocket) {
 	x.sock = sock
 	x.peers = make(map[uint32]*busEp)
+	x.ttl = defaultTTL
+	x.origin = newOrigin()
 	x.w.Init()
 	x.w.Add()
 	go x.sender()
@@ -45,38 +52,40 @@ func (x *bus) Shutdown(expire time.Time) {
 	x.Unlock()
 
 	for id, peer := range peers {
-		pikago.DrainChannel(peer.q, expire)
-		close(peer.q)
+		peer.q.Drain(expire)
+		peer.q.Close()
 		delete(peers, id)
 	}
 }
 
-// Bottom sender.
-func (pe *busEp) peerSender() {
-	for {
-		m := <-pe.q
-		if m == nil {
-			return
-		}
-		if pe.ep.SendMsg(m) != nil {
-			m.Free()
-			return
-		}
-	}
-}
-
-func (x *bus) broadcast(m *pikago.Message, sender uint32) {
+// broadcast sends a message to every peer but the one it came from, or
+// only to the peer it is addressed to with SendTo.  Peers share one
+// message through Dup, so it must not be edited after this point;
+// anything that needs to change it calls Writable first.
+func (x *bus) broadcast(m *pikago.Message, sender uint32, stamped bool) {
 
+	var only uint32
+	if ep := m.Target(); ep != nil {
+		only = ep.GetID()
+	}
+	// Peers without the extension get the message without its header.
+	var plain *pikago.Message
 	x.Lock()
 	for id, pe := range x.peers {
-		if sender == id {
+		if sender == id || (only != 0 && only != id) {
 			continue
 		}
+		m := m
+		if stamped && !pe.ext {
+			if plain == nil {
+				plain = pikago.NewMessage(len(m.Body))
+				plain.Body = append(plain.Body, m.Body...)
+			}
+			m = plain
+		}
 		m = m.Dup()
 
-		select {
-		case pe.q <- m:
-		default:
+		if !pe.q.TryPut(m) {
 			// No room on outbound queue, drop it.
 			// Note that if we are passing on a linger/shutdown
 			// notification and we can't deliver due to queue
@@ -87,6 +96,9 @@ func (x *bus) broadcast(m *pikago.Message, sender uint32) {
 		}
 	}
 	x.Unlock()
+	if plain != nil {
+		plain.Free()
+	}
 }
 
 func (x *bus) sender() {
@@ -103,13 +115,22 @@ func (x *bus) sender() {
 				sq = x.sock.SendChannel()
 				continue
 			}
+			// We edit the header below, so take a private copy if
+			// the message is shared.
+			m = m.Writable()
 			// If a header was present, it means this message is
 			// being rebroadcast.  It should be a pipe ID.
-			if len(m.Header) >= 4 {
-				id = binary.BigEndian.Uint32(m.Header)
-				m.Header = m.Header[4:]
+			if v, err := m.PopHeaderUint32(); err == nil {
+				id = v
+			}
+			x.Lock()
+			dedup, ttl := x.dedup, x.ttl
+			x.Unlock()
+			if dedup && !x.stamp(m, ttl) {
+				m.Free()
+				continue
 			}
-			x.broadcast(m, id)
+			x.broadcast(m, id, dedup)
 			m.Free()
 		}
 	}
@@ -125,9 +146,17 @@ func (pe *busEp) receiver() {
 		if m == nil {
 			return
 		}
-		v := pe.ep.GetID()
-		m.Header = append(m.Header,
-			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		if pe.ext && !pe.x.accept(m) {
+			m.Free()
+			continue
+		}
+		m.AppendHeaderUint32(pe.ep.GetID())
+		if pe.ext {
+			// Raw sockets keep the extension header after the
+			// pipe ID, so that forwarding preserves it.
+			m.Header = append(m.Header, m.Body[:busExtLen]...)
+			m.Body = m.Body[busExtLen:]
+		}
 
 		select {
 		case rq <- m:
@@ -149,23 +178,28 @@ func (x *bus) AddEndpoint(ep pikago.Endpoint) {
 	if i, err := x.sock.GetOption(pikago.OptionWriteQLen); err == nil {
 		depth = i.(int)
 	}
-	pe := &busEp{ep: ep, x: x, q: make(chan *pikago.Message, depth)}
+	pe := &busEp{ep: ep, x: x, q: pikago.NewOutbox(ep, depth)}
+	pe.ext = hasExt(ep)
 	x.Lock()
 	x.peers[ep.GetID()] = pe
 	x.Unlock()
-	go pe.peerSender()
 	go pe.receiver()
 }
 
 func (x *bus) RemoveEndpoint(ep pikago.Endpoint) {
 	x.Lock()
 	if peer := x.peers[ep.GetID()]; peer != nil {
-		close(peer.q)
+		peer.q.Close()
 		delete(x.peers, ep.GetID())
 	}
 	x.Unlock()
 }
 
+// CanSendTo implements ProtocolTargeter; any peer can be addressed.
+func (*bus) CanSendTo() bool {
+	return true
+}
+
 func (*bus) Number() uint16 {
 	return pikago.ProtoBus
 }
@@ -183,12 +217,23 @@ func (*bus) PeerName() string {
 }
 
 func (x *bus) RecvHook(m *pikago.Message) bool {
-	if !x.raw && len(m.Header) >= 4 {
-		m.Header = m.Header[4:]
+	if !x.raw {
+		// Drop the pipe ID and any extension header.
+		m.Header = m.Header[:0]
 	}
 	return true
 }
 
+// Extensions offers the extension header when OptionBusDedup is set.
+func (x *bus) Extensions() uint16 {
+	x.Lock()
+	defer x.Unlock()
+	if x.dedup {
+		return pikago.ExtBusHeader
+	}
+	return 0
+}
+
 func (x *bus) SetOption(name string, v interface{}) error {
 	var ok bool
 	switch name {
@@ -197,6 +242,24 @@ func (x *bus) SetOption(name string, v interface{}) error {
 			return pikago.ErrBadValue
 		}
 		return nil
+	case pikago.OptionBusDedup:
+		dedup, ok := v.(bool)
+		if !ok {
+			return pikago.ErrBadValue
+		}
+		x.Lock()
+		x.dedup = dedup
+		x.Unlock()
+		return nil
+	case pikago.OptionTTL:
+		ttl, ok := v.(int)
+		if !ok || ttl < 1 || ttl > 255 {
+			return pikago.ErrBadValue
+		}
+		x.Lock()
+		x.ttl = ttl
+		x.Unlock()
+		return nil
 	default:
 		return pikago.ErrBadOption
 	}
@@ -206,6 +269,14 @@ func (x *bus) GetOption(name string) (interface{}, error) {
 	switch name {
 	case pikago.OptionRaw:
 		return x.raw, nil
+	case pikago.OptionBusDedup:
+		x.Lock()
+		defer x.Unlock()
+		return x.dedup, nil
+	case pikago.OptionTTL:
+		x.Lock()
+		defer x.Unlock()
+		return x.ttl, nil
 	default:
 		return nil, pikago.ErrBadOption
 	}
@@ -0,0 +1,130 @@
+package bus
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/k4s/pikago"
+)
+
+// With OptionBusDedup, messages exchanged with peers that negotiated
+// ExtBusHeader start with an extension header: the 8 byte ID of the
+// socket that first sent the message, a 4 byte sequence number assigned
+// by that socket, and a 4 byte hop count, all big-endian.
+const busExtLen = 16
+
+// defaultTTL is the default maximum number of hops.
+const defaultTTL = 8
+
+// seenSize is the number of recent messages remembered for duplicate
+// detection.  Messages older than that may be delivered again if they
+// arrive over a very slow path.
+const seenSize = 4096
+
+var origins struct {
+	r *rand.Rand
+	sync.Mutex
+}
+
+func init() {
+	origins.r = rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// newOrigin returns an ID for a socket, random so that sockets in
+// different processes do not collide.
+func newOrigin() uint64 {
+	origins.Lock()
+	defer origins.Unlock()
+	for {
+		if v := origins.r.Uint64(); v != 0 {
+			return v
+		}
+	}
+}
+
+type busKey struct {
+	origin uint64
+	seq    uint32
+}
+
+// seenSet remembers the last seenSize messages received.
+type seenSet struct {
+	keys map[busKey]struct{}
+	ring []busKey
+	next int
+	sync.Mutex
+}
+
+// add records a message and reports whether it is new.
+func (s *seenSet) add(k busKey) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[busKey]struct{}, seenSize)
+		s.ring = make([]busKey, 0, seenSize)
+	}
+	if _, ok := s.keys[k]; ok {
+		return false
+	}
+	if len(s.ring) < seenSize {
+		s.ring = append(s.ring, k)
+	} else {
+		delete(s.keys, s.ring[s.next])
+		s.ring[s.next] = k
+		s.next = (s.next + 1) % seenSize
+	}
+	s.keys[k] = struct{}{}
+	return true
+}
+
+// stamp gives a message the extension header.  Messages forwarded by a
+// raw socket keep their origin and sequence and gain a hop; it returns
+// false if that exceeds the TTL.
+func (x *bus) stamp(m *pikago.Message, ttl int) bool {
+	var hdr [busExtLen]byte
+	if len(m.Header) >= busExtLen {
+		copy(hdr[:], m.Header)
+		hops := binary.BigEndian.Uint32(hdr[12:]) + 1
+		if hops > uint32(ttl) {
+			return false
+		}
+		binary.BigEndian.PutUint32(hdr[12:], hops)
+	} else {
+		x.Lock()
+		x.seq++
+		seq := x.seq
+		x.Unlock()
+		binary.BigEndian.PutUint64(hdr[:], x.origin)
+		binary.BigEndian.PutUint32(hdr[8:], seq)
+		binary.BigEndian.PutUint32(hdr[12:], 1)
+	}
+	m.Header = append(m.Header[:0], hdr[:]...)
+	return true
+}
+
+// accept checks the extension header at the front of a received body,
+// dropping malformed messages, messages that exceeded the TTL, our own
+// messages coming back around a loop, and duplicates.
+func (x *bus) accept(m *pikago.Message) bool {
+	if len(m.Body) < busExtLen {
+		return false
+	}
+	origin := binary.BigEndian.Uint64(m.Body)
+	seq := binary.BigEndian.Uint32(m.Body[8:])
+	hops := binary.BigEndian.Uint32(m.Body[12:])
+	x.Lock()
+	ttl := x.ttl
+	x.Unlock()
+	if hops == 0 || hops > uint32(ttl) || origin == x.origin {
+		return false
+	}
+	return x.seen.add(busKey{origin, seq})
+}
+
+// hasExt reports whether the peer negotiated the extension header.
+func hasExt(ep pikago.Endpoint) bool {
+	v, err := ep.GetProp(pikago.PropExtensions)
+	return err == nil && v.(uint16)&pikago.ExtBusHeader != 0
+}
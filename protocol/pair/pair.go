@@ -10,50 +10,116 @@ import (
 )
 
 type pair struct {
-	sock pikago.ProtocolSocket
-	peer *pairEp
-	raw  bool
-	w    pikago.Waiter
+	sock  pikago.ProtocolSocket
+	peer  *pairEp
+	raw   bool
+	steal bool
+	limit int               // most messages held while no peer is attached
+	held  []*pikago.Message // messages waiting for a peer, oldest first
+	wake  chan struct{}     // signalled when the peer or limit changes
+	w     pikago.Waiter
 	sync.Mutex
 }
 
 type pairEp struct {
 	ep pikago.Endpoint
-	cq chan struct{}
 }
 
 func (x *pair) Init(sock pikago.ProtocolSocket) {
 	x.sock = sock
+	x.wake = make(chan struct{}, 1)
 	x.w.Init()
+	x.w.Add()
+	go x.sender()
 }
 
 func (x *pair) Shutdown(expire time.Time) {
 	x.w.WaitAbsTimeout(expire)
 }
 
-func (x *pair) sender(ep *pairEp) {
+func (x *pair) notify() {
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+}
+
+// hold keeps a message until a peer is attached.  Messages that were
+// already taken for a peer that went away go back to the front; if the
+// buffer is full they are dropped.
+func (x *pair) hold(m *pikago.Message, front bool) {
+	x.Lock()
+	defer x.Unlock()
+	if len(x.held) >= x.limit {
+		m.Free()
+		return
+	}
+	if front {
+		x.held = append([]*pikago.Message{m}, x.held...)
+	} else {
+		x.held = append(x.held, m)
+	}
+}
+
+func (x *pair) sender() {
 
 	defer x.w.Done()
 	sq := x.sock.SendChannel()
 	cq := x.sock.CloseChannel()
+	var dead *pairEp // peer whose last send failed
+
+	defer func() {
+		x.Lock()
+		for _, m := range x.held {
+			m.Free()
+		}
+		x.held = nil
+		x.Unlock()
+	}()
 
-	// This is pretty easy because we have only one peer at a time.
-	// If the peer goes away, we'll just drop the message on the floor.
 	for {
-		select {
-		case m := <-sq:
-			if m == nil {
-				sq = x.sock.SendChannel()
-				continue
+		x.Lock()
+		peer := x.peer
+		if peer == dead {
+			peer = nil
+		}
+		var m *pikago.Message
+		if peer != nil && len(x.held) > 0 {
+			m = x.held[0]
+			x.held = x.held[1:]
+		}
+		full := len(x.held) >= x.limit
+		x.Unlock()
+
+		if m == nil {
+			// While there is no peer and the buffer is full, leave
+			// messages in the socket's queue so that Send pushes
+			// back instead of dropping.
+			in := sq
+			if peer == nil && full {
+				in = nil
 			}
-			if ep.ep.SendMsg(m) != nil {
-				m.Free()
+			select {
+			case m = <-in:
+				if m == nil {
+					sq = x.sock.SendChannel()
+					continue
+				}
+			case <-x.wake:
+				continue
+			case <-cq:
 				return
 			}
-		case <-ep.cq:
-			return
-		case <-cq:
-			return
+			if peer == nil {
+				x.hold(m, false)
+				continue
+			}
+		}
+
+		if peer.ep.SendMsg(m) != nil {
+			// The peer went away; save the message for the next one.
+			dead = peer
+			x.hold(m, true)
 		}
 	}
 }
@@ -78,9 +144,10 @@ func (x *pair) receiver(ep *pairEp) {
 }
 
 func (x *pair) AddEndpoint(ep pikago.Endpoint) {
-	peer := &pairEp{cq: make(chan struct{}), ep: ep}
+	peer := &pairEp{ep: ep}
 	x.Lock()
-	if x.peer != nil {
+	old := x.peer
+	if old != nil && !x.steal {
 		// We already have a connection, reject this one.
 		x.Unlock()
 		ep.Close()
@@ -89,18 +156,21 @@ func (x *pair) AddEndpoint(ep pikago.Endpoint) {
 	x.peer = peer
 	x.Unlock()
 
-	x.w.Add()
+	if old != nil {
+		// The new peer replaces the existing one.
+		old.ep.Close()
+	}
+	x.notify()
 	go x.receiver(peer)
-	go x.sender(peer)
 }
 
 func (x *pair) RemoveEndpoint(ep pikago.Endpoint) {
 	x.Lock()
 	if peer := x.peer; peer != nil && peer.ep == ep {
 		x.peer = nil
-		close(peer.cq)
 	}
 	x.Unlock()
+	x.notify()
 }
 
 func (*pair) Number() uint16 {
@@ -127,6 +197,25 @@ func (x *pair) SetOption(name string, v interface{}) error {
 			return pikago.ErrBadValue
 		}
 		return nil
+	case pikago.OptionStealPeer:
+		steal, ok := v.(bool)
+		if !ok {
+			return pikago.ErrBadValue
+		}
+		x.Lock()
+		x.steal = steal
+		x.Unlock()
+		return nil
+	case pikago.OptionOfflineQLen:
+		limit, ok := v.(int)
+		if !ok || limit < 0 {
+			return pikago.ErrBadValue
+		}
+		x.Lock()
+		x.limit = limit
+		x.Unlock()
+		x.notify()
+		return nil
 	default:
 		return pikago.ErrBadOption
 	}
@@ -136,6 +225,14 @@ func (x *pair) GetOption(name string) (interface{}, error) {
 	switch name {
 	case pikago.OptionRaw:
 		return x.raw, nil
+	case pikago.OptionStealPeer:
+		x.Lock()
+		defer x.Unlock()
+		return x.steal, nil
+	case pikago.OptionOfflineQLen:
+		x.Lock()
+		defer x.Unlock()
+		return x.limit, nil
 	default:
 		return nil, pikago.ErrBadOption
 	}
@@ -0,0 +1,244 @@
+// Package pair1 implements version 1 of the PAIR protocol.  Like PAIR,
+// this is a peering protocol, but in polyamorous mode a socket may be
+// connected to many peers at once.  Every message carries a hop count,
+// so that it can safely travel through devices.
+package pair1
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/k4s/pikago"
+)
+
+// defaultTTL is the default maximum number of hops, matching nng.
+const defaultTTL = 8
+
+type pair1 struct {
+	sock pikago.ProtocolSocket
+	raw  bool
+	poly bool
+	ttl  int
+	d    pikago.Dispatcher
+	peer pikago.Endpoint // the only peer, when not polyamorous
+	w    pikago.Waiter
+	sync.Mutex
+}
+
+func (x *pair1) Init(sock pikago.ProtocolSocket) {
+	x.sock = sock
+	x.ttl = defaultTTL
+	x.d.Init(nil)
+	x.w.Init()
+	x.w.Add()
+	go x.sender()
+}
+
+func (x *pair1) Shutdown(expire time.Time) {
+	x.w.WaitAbsTimeout(expire)
+	x.d.Drain(expire)
+}
+
+// target returns the peer the message is addressed to, or zero if it may
+// go to any peer.  Messages sent with SendTo are always addressed; in
+// polyamorous mode so are replies that reuse a received message's Port.
+func target(m *pikago.Message, poly bool) uint32 {
+	if ep := m.Target(); ep != nil {
+		return ep.GetID()
+	}
+	if ep, ok := m.Port.(pikago.Endpoint); ok && poly {
+		return ep.GetID()
+	}
+	return 0
+}
+
+func (x *pair1) sender() {
+	defer x.w.Done()
+	sq := x.sock.SendChannel()
+	cq := x.sock.CloseChannel()
+
+	for {
+		var m *pikago.Message
+		select {
+		case m = <-sq:
+			if m == nil {
+				sq = x.sock.SendChannel()
+				continue
+			}
+		case <-cq:
+			return
+		}
+
+		x.Lock()
+		raw, ttl, poly := x.raw, x.ttl, x.poly
+		x.Unlock()
+
+		// Cooked messages start their journey here; raw messages
+		// carry the hop count they arrived with, which we bump.
+		var hops uint32 = 1
+		if raw {
+			v, err := m.PopHeaderUint32()
+			if err != nil {
+				m.Free()
+				continue
+			}
+			hops = v + 1
+		}
+		if hops > uint32(ttl) {
+			m.Free()
+			continue
+		}
+		m.Header = m.Header[:0]
+		m.AppendHeaderUint32(hops)
+
+		if id := target(m, poly); id != 0 {
+			// The addressed peer is gone, so drop it rather
+			// than deliver a reply to the wrong party.
+			if !x.d.SendTo(m, id, cq) {
+				m.Free()
+			}
+			continue
+		}
+		if x.d.Send(m, cq) == nil {
+			m.Free()
+			return
+		}
+	}
+}
+
+func (x *pair1) receiver(ep pikago.Endpoint) {
+	rq := x.sock.RecvChannel()
+	cq := x.sock.CloseChannel()
+
+	for {
+		m := ep.RecvMsg()
+		if m == nil {
+			return
+		}
+		if len(m.Body) < 4 {
+			m.Free()
+			continue
+		}
+		hops := binary.BigEndian.Uint32(m.Body)
+		x.Lock()
+		raw, ttl := x.raw, x.ttl
+		x.Unlock()
+		// The upper bits are reserved and must be zero.
+		if hops&0xffffff00 != 0 || hops == 0 || hops > uint32(ttl) {
+			m.Free()
+			continue
+		}
+		if raw {
+			m.AppendHeaderUint32(hops)
+		}
+		m.Body = m.Body[4:]
+
+		select {
+		case rq <- m:
+		case <-cq:
+			m.Free()
+			return
+		}
+	}
+}
+
+func (x *pair1) AddEndpoint(ep pikago.Endpoint) {
+	x.Lock()
+	if !x.poly {
+		if x.peer != nil {
+			// We already have a connection, reject this one.
+			x.Unlock()
+			ep.Close()
+			return
+		}
+		x.peer = ep
+	}
+	x.Unlock()
+
+	x.d.Add(ep)
+	go x.receiver(ep)
+}
+
+func (x *pair1) RemoveEndpoint(ep pikago.Endpoint) {
+	x.Lock()
+	if x.peer == ep {
+		x.peer = nil
+	}
+	x.Unlock()
+	x.d.Remove(ep)
+}
+
+// CanSendTo implements ProtocolTargeter; any peer can be addressed.
+func (*pair1) CanSendTo() bool {
+	return true
+}
+
+func (*pair1) Number() uint16 {
+	return pikago.ProtoPair1
+}
+
+func (*pair1) Name() string {
+	return "pair1"
+}
+
+func (*pair1) PeerNumber() uint16 {
+	return pikago.ProtoPair1
+}
+
+func (*pair1) PeerName() string {
+	return "pair1"
+}
+
+func (x *pair1) SetOption(name string, v interface{}) error {
+	x.Lock()
+	defer x.Unlock()
+	switch name {
+	case pikago.OptionRaw:
+		raw, ok := v.(bool)
+		if !ok {
+			return pikago.ErrBadValue
+		}
+		x.raw = raw
+		return nil
+	case pikago.OptionPolyamorous:
+		poly, ok := v.(bool)
+		if !ok {
+			return pikago.ErrBadValue
+		}
+		if poly != x.poly && (x.peer != nil || x.d.Len() > 0) {
+			return pikago.ErrProtoState
+		}
+		x.poly = poly
+		return nil
+	case pikago.OptionTTL:
+		ttl, ok := v.(int)
+		if !ok || ttl < 1 || ttl > 255 {
+			return pikago.ErrBadValue
+		}
+		x.ttl = ttl
+		return nil
+	default:
+		return pikago.ErrBadOption
+	}
+}
+
+func (x *pair1) GetOption(name string) (interface{}, error) {
+	x.Lock()
+	defer x.Unlock()
+	switch name {
+	case pikago.OptionRaw:
+		return x.raw, nil
+	case pikago.OptionPolyamorous:
+		return x.poly, nil
+	case pikago.OptionTTL:
+		return x.ttl, nil
+	default:
+		return nil, pikago.ErrBadOption
+	}
+}
+
+// NewSocket allocates a new Socket using version 1 of the PAIR protocol.
+func NewSocket() (pikago.Socket, error) {
+	return pikago.MakeSocket(&pair1{}), nil
+}
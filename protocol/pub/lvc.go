@@ -0,0 +1,101 @@
+package pub
+
+import (
+	"container/list"
+
+	"github.com/k4s/pikago"
+)
+
+// lastValues is the last-value cache used to bring late joiners up to
+// date.  With a key function it keeps the latest message for each key,
+// otherwise the latest messages regardless of key.  Either way it holds
+// at most size entries, evicting the least recently updated first, and
+// replays them oldest first.
+type lastValues struct {
+	size  int
+	keyf  pikago.KeyFunc
+	items map[string]*list.Element
+	order list.List
+}
+
+type lastValue struct {
+	key string
+	m   *pikago.Message
+}
+
+func newLastValues(size int, keyf pikago.KeyFunc) *lastValues {
+	c := &lastValues{size: size, keyf: keyf}
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	return c
+}
+
+// key returns the cache key of a message, or nil without a key function.
+// It only reads keyf, which never changes, so it needs no lock.
+func (c *lastValues) key(m *pikago.Message) []byte {
+	if c.keyf == nil {
+		return nil
+	}
+	return c.keyf(m)
+}
+
+// update records a published message under the key that key returned
+// for it.  The cache keeps its own copy, so that cached messages do not
+// count against the socket's buffer budget.
+func (c *lastValues) update(m *pikago.Message, k []byte) {
+	var key string
+	if c.keyf != nil {
+		if k == nil {
+			return
+		}
+		key = string(k)
+		if e, ok := c.items[key]; ok {
+			c.remove(e)
+		}
+	}
+
+	cp := pikago.NewMessage(len(m.Body))
+	cp.Body = append(cp.Body, m.Body...)
+	e := c.order.PushBack(&lastValue{key: key, m: cp})
+	if c.keyf != nil {
+		c.items[key] = e
+	}
+	for c.order.Len() > c.size {
+		c.remove(c.order.Front())
+	}
+}
+
+// replay returns references to the cached messages accepted by want,
+// oldest first.  The caller must send or free them.
+func (c *lastValues) replay(want func(*pikago.Message) bool) []*pikago.Message {
+	var out []*pikago.Message
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		if m := e.Value.(*lastValue).m; want(m) {
+			out = append(out, m.Dup())
+		}
+	}
+	return out
+}
+
+// resize changes the number of entries kept, evicting the oldest.
+func (c *lastValues) resize(size int) {
+	c.size = size
+	for c.order.Len() > c.size {
+		c.remove(c.order.Front())
+	}
+}
+
+func (c *lastValues) remove(e *list.Element) {
+	lv := c.order.Remove(e).(*lastValue)
+	if c.keyf != nil {
+		delete(c.items, lv.key)
+	}
+	lv.m.Free()
+}
+
+// flush releases every cached message.
+func (c *lastValues) flush() {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		c.remove(e)
+	}
+}
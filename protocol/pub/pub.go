@@ -1,30 +1,69 @@
 package pub
 
 import (
+	"bytes"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/k4s/pikago"
 )
 
+// Slow consumer policies, the values of OptionSlowConsumerPolicy.
+const (
+	DropNewest = iota // drop the message being published
+	DropOldest        // drop the oldest queued message to make room
+	Block             // wait up to OptionSlowConsumerTimeout, then drop
+	Disconnect        // drop, and close the peer after OptionSlowConsumerLimit drops
+)
+
+const defaultSlowLimit = 100
+
+// defaultSlowTimeout bounds how long the Block policy stalls a publish,
+// so that one stuck subscriber cannot stop the sender for good.
+const defaultSlowTimeout = time.Second
+
 type pub struct {
-	sock pikago.ProtocolSocket
-	eps  map[uint32]*pubEp
-	raw  bool
-	w    pikago.Waiter
+	sock    pikago.ProtocolSocket
+	eps     map[uint32]*pubEp
+	raw     bool
+	w       pikago.Waiter
+	policy  int
+	timeout time.Duration
+	limit   int
+	depth   int  // 0 means use OptionWriteQLen
+	filter  bool // OptionPublisherFilter
+	lvc     *lastValues
+	lvcSize int
+	lvcKey  pikago.KeyFunc
+	ctlq    chan pubCtl
 	sync.Mutex
 }
 
+// pubCtl is a subscription frame from a filtering peer.  Frames are
+// applied by the top sender, so that replays from the last-value cache
+// stay ordered with live messages.
+type pubCtl struct {
+	pe *pubEp
+	m  *pikago.Message
+}
+
 type pubEp struct {
-	ep pikago.Endpoint
-	q  chan *pikago.Message
-	p  *pub
-	w  pikago.Waiter
+	dropped uint64 // accessed atomically
+	ep      pikago.Endpoint
+	q       chan *pikago.Message
+	cq      chan struct{}
+	p       *pub
+	subs    *pikago.PrefixSet // nil unless the peer forwards its subscriptions
+	replay  []*pikago.Message // last values to send before live traffic
 }
 
 func (p *pub) Init(sock pikago.ProtocolSocket) {
 	p.sock = sock
 	p.eps = make(map[uint32]*pubEp)
+	p.limit = defaultSlowLimit
+	p.timeout = defaultSlowTimeout
+	p.ctlq = make(chan pubCtl)
 	p.sock.SetRecvError(pikago.ErrProtoOp)
 	p.w.Init()
 	p.w.Add()
@@ -42,74 +81,297 @@ func (p *pub) Shutdown(expire time.Time) {
 
 	for id, peer := range peers {
 		pikago.DrainChannel(peer.q, expire)
-		close(peer.q)
+		close(peer.cq)
 		delete(peers, id)
 	}
+
+	p.Lock()
+	if p.lvc != nil {
+		p.lvc.flush()
+	}
+	p.Unlock()
 }
 
 // Bottom sender.
 func (pe *pubEp) peerSender() {
 
-	for {
-		m := <-pe.q
-		if m == nil {
+	for i, m := range pe.replay {
+		if pe.ep.SendMsg(m) != nil {
+			m.Free()
+			for _, m := range pe.replay[i+1:] {
+				m.Free()
+			}
 			break
 		}
+	}
+	pe.replay = nil
 
-		if pe.ep.SendMsg(m) != nil {
+	for {
+		select {
+		case m := <-pe.q:
+			// On failure keep going: the endpoint is being removed,
+			// and the queue must be emptied until it is.
+			if pe.ep.SendMsg(m) != nil {
+				m.Free()
+			}
+		case <-pe.cq:
+			pe.drain()
+			return
+		}
+	}
+}
+
+// drain frees whatever is left in the queue of a removed peer.
+func (pe *pubEp) drain() {
+	for {
+		select {
+		case m := <-pe.q:
 			m.Free()
-			break
+		default:
+			return
+		}
+	}
+}
+
+// queued is called after a message was put on the queue.  If the peer
+// was removed meanwhile its sender may already have drained the queue
+// for the last time, so drain it here instead.
+func (pe *pubEp) queued() {
+	select {
+	case <-pe.cq:
+		pe.drain()
+	default:
+	}
+}
+
+// drop records a message dropped for this peer.
+func (pe *pubEp) drop(policy, limit int) {
+	n := atomic.AddUint64(&pe.dropped, 1)
+	if policy == Disconnect && n >= uint64(limit) {
+		pe.ep.Close()
+	}
+}
+
+// put queues m for this peer, applying the slow consumer policy when
+// the queue is full.  It always takes ownership of m.
+func (pe *pubEp) put(m *pikago.Message, policy, limit int, expire <-chan time.Time, cq <-chan struct{}) {
+	select {
+	case pe.q <- m:
+		pe.queued()
+		return
+	default:
+	}
+
+	switch policy {
+	case DropOldest:
+		for {
+			select {
+			case pe.q <- m:
+				pe.queued()
+				return
+			default:
+			}
+			select {
+			case old := <-pe.q:
+				old.Free()
+				pe.drop(policy, limit)
+			default:
+			}
+		}
+	case Block:
+		select {
+		case pe.q <- m:
+			pe.queued()
+			return
+		case <-pe.cq:
+			m.Free()
+			return
+		case <-cq:
+			m.Free()
+			return
+		case <-expire:
+		}
+	}
+	m.Free()
+	pe.drop(policy, limit)
+}
+
+// wants reports whether the peer subscribed to the message.  Peers
+// that do not filter at the publisher want everything.
+func (pe *pubEp) wants(m *pikago.Message) bool {
+	return pe.subs == nil || pe.subs.Match(m.Body)
+}
+
+// subsReceiver passes the subscription frames sent by a SUB peer that
+// negotiated ExtPubFilter to the top sender.
+func (pe *pubEp) subsReceiver() {
+	cq := pe.p.sock.CloseChannel()
+	for {
+		m := pe.ep.RecvMsg()
+		if m == nil {
+			return
+		}
+		select {
+		case pe.p.ctlq <- pubCtl{pe: pe, m: m}:
+		case <-pe.cq:
+			m.Free()
+			return
+		case <-cq:
+			m.Free()
+			return
 		}
 	}
 }
 
+// control applies a subscription frame.  The first body byte is 1 to
+// subscribe or 0 to unsubscribe, followed by the prefix.  A new
+// subscription is sent the cached last values it now matches.
+func (p *pub) control(pe *pubEp, m *pikago.Message, cq <-chan struct{}) {
+	defer m.Free()
+	if len(m.Body) == 0 {
+		return
+	}
+	prefix := m.Body[1:]
+	switch m.Body[0] {
+	case 0:
+		pe.subs.Remove(prefix)
+		return
+	case 1:
+	default:
+		return
+	}
+
+	p.Lock()
+	var replay []*pikago.Message
+	if p.lvc != nil {
+		replay = p.lvc.replay(func(c *pikago.Message) bool {
+			return bytes.HasPrefix(c.Body, prefix) && !pe.subs.Match(c.Body)
+		})
+	}
+	pe.subs.Add(prefix)
+	policy, limit, timer, expire := p.slowPolicy()
+	p.Unlock()
+
+	for _, m := range replay {
+		pe.put(m, policy, limit, expire, cq)
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// slowPolicy returns the slow consumer settings for one publish, with a
+// timer for the Block policy.  The caller must hold the lock, and stop
+// the timer when done.
+func (p *pub) slowPolicy() (int, int, *time.Timer, <-chan time.Time) {
+	if p.policy == Block {
+		timer := time.NewTimer(p.timeout)
+		return p.policy, p.limit, timer, timer.C
+	}
+	return p.policy, p.limit, nil, nil
+}
+
 // Top sender.
 func (p *pub) sender() {
 	defer p.w.Done()
 
 	cq := p.sock.CloseChannel()
 	sq := p.sock.SendChannel()
+	var peers []*pubEp
 
 	for {
 		select {
 		case <-cq:
 			return
 
+		case c := <-p.ctlq:
+			p.control(c.pe, c.m, cq)
+
 		case m := <-sq:
 			if m == nil {
 				sq = p.sock.SendChannel()
 				continue
 			}
 
+			// The cache key is a user function, so it is computed
+			// without the lock.  A cache replaced meanwhile, with a
+			// new key function, is not updated.
 			p.Lock()
+			lvc := p.lvc
+			p.Unlock()
+			var key []byte
+			if lvc != nil {
+				key = lvc.key(m)
+			}
+
+			// Queue outside the lock, since the Block policy may
+			// wait on a slow peer.
+			p.Lock()
+			peers = peers[:0]
 			for _, peer := range p.eps {
-				m := m.Dup()
-				select {
-				case peer.q <- m:
-				default:
-					m.Free()
-				}
+				peers = append(peers, peer)
 			}
+			if lvc != nil && lvc == p.lvc {
+				lvc.update(m, key)
+			}
+			policy, limit, timer, expire := p.slowPolicy()
 			p.Unlock()
+
+			for _, peer := range peers {
+				if !peer.wants(m) {
+					continue
+				}
+				peer.put(m.Dup(), policy, limit, expire, cq)
+			}
+			if timer != nil {
+				timer.Stop()
+			}
 			m.Free()
 		}
 	}
 }
 
+// peerQLen returns the queue depth for new peers.  It must be called
+// without the lock, as the socket may ask the protocol for options.
+func (p *pub) peerQLen() int {
+	p.Lock()
+	depth := p.depth
+	p.Unlock()
+	if depth == 0 {
+		depth = 16
+		if i, err := p.sock.GetOption(pikago.OptionWriteQLen); err == nil {
+			depth = i.(int)
+		}
+	}
+	return depth
+}
+
 func (p *pub) AddEndpoint(ep pikago.Endpoint) {
-	depth := 16
-	if i, err := p.sock.GetOption(pikago.OptionWriteQLen); err == nil {
-		depth = i.(int)
+	pe := &pubEp{
+		ep: ep,
+		p:  p,
+		q:  make(chan *pikago.Message, p.peerQLen()),
+		cq: make(chan struct{}),
+	}
+	if v, err := ep.GetProp(pikago.PropExtensions); err == nil &&
+		v.(uint16)&pikago.ExtPubFilter != 0 {
+		pe.subs = &pikago.PrefixSet{}
 	}
-	pe := &pubEp{ep: ep, p: p, q: make(chan *pikago.Message, depth)}
-	pe.w.Init()
+	// Registering the peer and taking the snapshot under one lock means
+	// each message is either replayed or sent live, never both.
 	p.Lock()
 	p.eps[ep.GetID()] = pe
+	if p.lvc != nil {
+		pe.replay = p.lvc.replay(pe.wants)
+	}
 	p.Unlock()
 
-	pe.w.Add()
 	go pe.peerSender()
-	go pikago.NullRecv(ep)
+	if pe.subs != nil {
+		go pe.subsReceiver()
+	} else {
+		go pikago.NullRecv(ep)
+	}
 }
 
 func (p *pub) RemoveEndpoint(ep pikago.Endpoint) {
@@ -119,8 +381,32 @@ func (p *pub) RemoveEndpoint(ep pikago.Endpoint) {
 	delete(p.eps, id)
 	p.Unlock()
 	if pe != nil {
-		close(pe.q)
+		close(pe.cq)
+	}
+}
+
+// Extensions offers publisher filtering when OptionPublisherFilter is set.
+func (p *pub) Extensions() uint16 {
+	p.Lock()
+	defer p.Unlock()
+	if p.filter {
+		return pikago.ExtPubFilter
 	}
+	return 0
+}
+
+// PropHook reports the per-peer drop count as PropDropped.
+func (p *pub) PropHook(ep pikago.Endpoint, name string) (interface{}, error) {
+	if name != pikago.PropDropped {
+		return nil, pikago.ErrBadProperty
+	}
+	p.Lock()
+	pe := p.eps[ep.GetID()]
+	p.Unlock()
+	if pe == nil {
+		return nil, pikago.ErrBadProperty
+	}
+	return atomic.LoadUint64(&pe.dropped), nil
 }
 
 func (*pub) Number() uint16 {
@@ -141,26 +427,117 @@ func (*pub) PeerName() string {
 
 func (p *pub) SetOption(name string, v interface{}) error {
 	var ok bool
+	p.Lock()
+	defer p.Unlock()
 	switch name {
 	case pikago.OptionRaw:
 		if p.raw, ok = v.(bool); !ok {
 			return pikago.ErrBadValue
 		}
 		return nil
+	case pikago.OptionSlowConsumerPolicy:
+		policy, ok := v.(int)
+		if !ok || policy < DropNewest || policy > Disconnect {
+			return pikago.ErrBadValue
+		}
+		p.policy = policy
+		return nil
+	case pikago.OptionSlowConsumerTimeout:
+		timeout, ok := v.(time.Duration)
+		if !ok || timeout <= 0 {
+			return pikago.ErrBadValue
+		}
+		p.timeout = timeout
+		return nil
+	case pikago.OptionSlowConsumerLimit:
+		limit, ok := v.(int)
+		if !ok || limit < 1 {
+			return pikago.ErrBadValue
+		}
+		p.limit = limit
+		return nil
+	case pikago.OptionPeerQLen:
+		depth, ok := v.(int)
+		if !ok || depth < 1 {
+			return pikago.ErrBadValue
+		}
+		p.depth = depth
+		return nil
+	case pikago.OptionPublisherFilter:
+		if p.filter, ok = v.(bool); !ok {
+			return pikago.ErrBadValue
+		}
+		return nil
+	case pikago.OptionLastValueCache:
+		size, ok := v.(int)
+		if !ok || size < 0 {
+			return pikago.ErrBadValue
+		}
+		p.lvcSize = size
+		p.resetCache(false)
+		return nil
+	case pikago.OptionLastValueKey:
+		var keyf pikago.KeyFunc
+		switch f := v.(type) {
+		case pikago.KeyFunc:
+			keyf = f
+		case func(*pikago.Message) []byte:
+			keyf = f
+		case nil:
+		default:
+			return pikago.ErrBadValue
+		}
+		p.lvcKey = keyf
+		p.resetCache(true)
+		return nil
 	default:
 		return pikago.ErrBadOption
 	}
 }
 
 func (p *pub) GetOption(name string) (interface{}, error) {
+	if name == pikago.OptionPeerQLen {
+		return p.peerQLen(), nil
+	}
+	p.Lock()
+	defer p.Unlock()
 	switch name {
 	case pikago.OptionRaw:
 		return p.raw, nil
+	case pikago.OptionSlowConsumerPolicy:
+		return p.policy, nil
+	case pikago.OptionSlowConsumerTimeout:
+		return p.timeout, nil
+	case pikago.OptionSlowConsumerLimit:
+		return p.limit, nil
+	case pikago.OptionPublisherFilter:
+		return p.filter, nil
+	case pikago.OptionLastValueCache:
+		return p.lvcSize, nil
+	case pikago.OptionLastValueKey:
+		return p.lvcKey, nil
 	default:
 		return nil, pikago.ErrBadOption
 	}
 }
 
+// resetCache applies the last-value cache settings.  Changing the key
+// function empties the cache, since its entries were keyed differently.
+// The caller must hold the lock.
+func (p *pub) resetCache(rekey bool) {
+	if p.lvc != nil && (rekey || p.lvcSize == 0) {
+		p.lvc.flush()
+		p.lvc = nil
+	}
+	switch {
+	case p.lvcSize == 0:
+	case p.lvc == nil:
+		p.lvc = newLastValues(p.lvcSize, p.lvcKey)
+	default:
+		p.lvc.resize(p.lvcSize)
+	}
+}
+
 // NewSocket allocates a new Socket using the PUB protocol.
 func NewSocket() (pikago.Socket, error) {
 	return pikago.MakeSocket(&pub{}), nil
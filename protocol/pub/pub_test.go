@@ -0,0 +1,41 @@
+package pub_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/k4s/pikago"
+	"github.com/k4s/pikago/protocol/pub"
+)
+
+// A last-value key function may call back into the socket.
+func TestLastValueKeyReentrant(t *testing.T) {
+	s, err := pub.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetOption(pikago.OptionLastValueCache, 4)
+	s.SetOption(pikago.OptionLastValueKey, func(m *pikago.Message) []byte {
+		s.GetOption(pikago.OptionLastValueCache)
+		return m.Body[:1]
+	})
+	if err = s.Send([]byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the sender time to run the key function, then check that
+	// the protocol lock is free.
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.GetOption(pikago.OptionLastValueCache)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		// Closing a stalled socket would hang too.
+		t.Fatal("socket stalled in the key function")
+	}
+	s.Close()
+}
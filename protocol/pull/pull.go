@@ -11,18 +11,20 @@ import (
 type pull struct {
 	sock pikago.ProtocolSocket
 	raw  bool
+	fq   pikago.FairQueue
 }
 
 func (x *pull) Init(sock pikago.ProtocolSocket) {
 	x.sock = sock
+	x.fq.Init(sock, 2)
 	x.sock.SetSendError(pikago.ErrProtoOp)
 }
 
 func (x *pull) Shutdown(time.Time) {} // No sender to drain
 
+// receiver queues messages from one peer; the fair queue decides which
+// peer's message goes up next, honoring the receive priorities.
 func (x *pull) receiver(ep pikago.Endpoint) {
-	rq := x.sock.RecvChannel()
-	cq := x.sock.CloseChannel()
 	for {
 
 		m := ep.RecvMsg()
@@ -30,9 +32,8 @@ func (x *pull) receiver(ep pikago.Endpoint) {
 			return
 		}
 
-		select {
-		case rq <- m:
-		case <-cq:
+		if !x.fq.Put(ep, m) {
+			m.Free()
 			return
 		}
 	}
@@ -55,10 +56,13 @@ func (*pull) PeerName() string {
 }
 
 func (x *pull) AddEndpoint(ep pikago.Endpoint) {
+	x.fq.Add(ep)
 	go x.receiver(ep)
 }
 
-func (x *pull) RemoveEndpoint(ep pikago.Endpoint) {}
+func (x *pull) RemoveEndpoint(ep pikago.Endpoint) {
+	x.fq.Remove(ep)
+}
 
 func (*pull) SendHook(msg *pikago.Message) bool {
 	return false
@@ -13,27 +13,31 @@ type push struct {
 	sock pikago.ProtocolSocket
 	raw  bool
 	w    pikago.Waiter
-	eps  map[uint32]*pushEp
+	d    pikago.Dispatcher
+	keyf pikago.KeyFunc
 	sync.Mutex
 }
 
-type pushEp struct {
-	ep pikago.Endpoint
-	cq chan struct{}
-}
-
 func (x *push) Init(sock pikago.ProtocolSocket) {
 	x.sock = sock
 	x.w.Init()
+	x.d.Init(nil)
 	x.sock.SetRecvError(pikago.ErrProtoOp)
-	x.eps = make(map[uint32]*pushEp)
+	x.w.Add()
+	go x.sender()
 }
 
 func (x *push) Shutdown(expire time.Time) {
 	x.w.WaitAbsTimeout(expire)
+	x.d.Drain(expire)
 }
 
-func (x *push) sender(ep *pushEp) {
+// sender hands each message to the peer with the best send priority
+// that has room in its send queue.  Lower priority peers only see
+// traffic when every higher priority peer has a full queue or is gone.
+// If a route key function is set, a message with a key always goes to
+// the peer owning that key instead.
+func (x *push) sender() {
 	defer x.w.Done()
 	sq := x.sock.SendChannel()
 	cq := x.sock.CloseChannel()
@@ -42,14 +46,18 @@ func (x *push) sender(ep *pushEp) {
 		select {
 		case <-cq:
 			return
-		case <-ep.cq:
-			return
 		case m := <-sq:
 			if m == nil {
 				sq = x.sock.SendChannel()
 				continue
 			}
-			if ep.ep.SendMsg(m) != nil {
+			var ep pikago.Endpoint
+			if key := x.routeKey(m); key != nil {
+				ep = x.d.SendKey(m, key, cq)
+			} else {
+				ep = x.d.Send(m, cq)
+			}
+			if ep == nil {
 				m.Free()
 				return
 			}
@@ -57,6 +65,16 @@ func (x *push) sender(ep *pushEp) {
 	}
 }
 
+func (x *push) routeKey(m *pikago.Message) []byte {
+	x.Lock()
+	keyf := x.keyf
+	x.Unlock()
+	if keyf == nil {
+		return nil
+	}
+	return keyf(m)
+}
+
 func (*push) Number() uint16 {
 	return pikago.ProtoPush
 }
@@ -74,24 +92,12 @@ func (*push) PeerName() string {
 }
 
 func (x *push) AddEndpoint(ep pikago.Endpoint) {
-	pe := &pushEp{ep: ep, cq: make(chan struct{})}
-	x.Lock()
-	x.eps[ep.GetID()] = pe
-	x.Unlock()
-	x.w.Add()
-	go x.sender(pe)
+	x.d.Add(ep)
 	go pikago.NullRecv(ep)
 }
 
 func (x *push) RemoveEndpoint(ep pikago.Endpoint) {
-	id := ep.GetID()
-	x.Lock()
-	pe := x.eps[id]
-	delete(x.eps, id)
-	x.Unlock()
-	if pe != nil {
-		close(pe.cq)
-	}
+	x.d.Remove(ep)
 }
 
 func (x *push) SetOption(name string, v interface{}) error {
@@ -102,6 +108,21 @@ func (x *push) SetOption(name string, v interface{}) error {
 			return pikago.ErrBadValue
 		}
 		return nil
+	case pikago.OptionRouteKey:
+		var keyf pikago.KeyFunc
+		switch f := v.(type) {
+		case pikago.KeyFunc:
+			keyf = f
+		case func(*pikago.Message) []byte:
+			keyf = f
+		case nil:
+		default:
+			return pikago.ErrBadValue
+		}
+		x.Lock()
+		x.keyf = keyf
+		x.Unlock()
+		return nil
 	default:
 		return pikago.ErrBadOption
 	}
@@ -111,6 +132,10 @@ func (x *push) GetOption(name string) (interface{}, error) {
 	switch name {
 	case pikago.OptionRaw:
 		return x.raw, nil
+	case pikago.OptionRouteKey:
+		x.Lock()
+		defer x.Unlock()
+		return x.keyf, nil
 	default:
 		return nil, pikago.ErrBadOption
 	}
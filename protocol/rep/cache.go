@@ -0,0 +1,122 @@
+package rep
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/k4s/pikago"
+)
+
+// replyCache remembers the replies sent for recent requests, keyed by
+// the pipe ID and backtrace (which ends with the request ID).  A request
+// that is resent by its initiator can then be answered again without
+// reaching the application.  Requests still being worked on are kept as
+// pending entries, so duplicates of them are dropped.  Pending entries
+// live at most pendingTTL, so a request the application dropped without
+// replying does not swallow its retries for the whole TTL.  The cache is
+// bounded both in entries and in age, and evicts least recently used
+// entries first.
+type replyCache struct {
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	lru   list.List
+}
+
+type cacheEntry struct {
+	key    string
+	reply  *pikago.Message // nil while the request is pending
+	expire time.Time
+}
+
+// pendingTTL bounds how long duplicates of an unanswered request are
+// dropped.
+const pendingTTL = time.Second * 30
+
+func newReplyCache(size int, ttl time.Duration) *replyCache {
+	c := &replyCache{size: size, ttl: ttl}
+	c.items = make(map[string]*list.Element)
+	c.lru.Init()
+	return c
+}
+
+// lookup reports whether the key is known.  If a reply was cached, a
+// reference to it is returned, which the caller must send or free.
+func (c *replyCache) lookup(key string) (*pikago.Message, bool) {
+	c.expire()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	ce := e.Value.(*cacheEntry)
+	if !time.Now().Before(ce.expire) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	if ce.reply != nil {
+		return ce.reply.Dup(), true
+	}
+	return nil, true
+}
+
+// pending records a request that was handed to the application.
+func (c *replyCache) pending(key string) {
+	ttl := c.ttl
+	if ttl > pendingTTL {
+		ttl = pendingTTL
+	}
+	c.add(key, nil, ttl)
+}
+
+// forget drops the pending entry for a request the application will not
+// answer, so that its retries reach the application again.
+func (c *replyCache) forget(key string) {
+	if e, ok := c.items[key]; ok && e.Value.(*cacheEntry).reply == nil {
+		c.remove(e)
+	}
+}
+
+// store records the reply for a request, taking ownership of it.
+func (c *replyCache) store(key string, reply *pikago.Message) {
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	c.add(key, reply, c.ttl)
+}
+
+func (c *replyCache) add(key string, reply *pikago.Message, ttl time.Duration) {
+	ce := &cacheEntry{key: key, reply: reply, expire: time.Now().Add(ttl)}
+	c.items[key] = c.lru.PushFront(ce)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// expire drops entries that have outlived the TTL.  Entries are not
+// strictly ordered by age, since lookups refresh their position, so
+// this only trims from the least recently used end.
+func (c *replyCache) expire() {
+	now := time.Now()
+	for e := c.lru.Back(); e != nil; e = c.lru.Back() {
+		if now.Before(e.Value.(*cacheEntry).expire) {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+func (c *replyCache) remove(e *list.Element) {
+	ce := c.lru.Remove(e).(*cacheEntry)
+	delete(c.items, ce.key)
+	if ce.reply != nil {
+		ce.reply.Free()
+	}
+}
+
+// flush drops every entry.
+func (c *replyCache) flush() {
+	for e := c.lru.Back(); e != nil; e = c.lru.Back() {
+		c.remove(e)
+	}
+}
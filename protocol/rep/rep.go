@@ -11,11 +11,8 @@ import (
 )
 
 type repEp struct {
-	q    chan *pikago.Message
-	ep   pikago.Endpoint
-	sock pikago.ProtocolSocket
-	w    pikago.Waiter
-	r    *rep
+	q  *pikago.Outbox
+	ep pikago.Endpoint
 }
 
 type rep struct {
@@ -27,15 +24,25 @@ type rep struct {
 	raw          bool
 	ttl          int
 	w            pikago.Waiter
+	fq           pikago.FairQueue
+	cache        *replyCache
+	cacheSize    int
+	cacheTTL     time.Duration
 
 	sync.Mutex
 }
 
+// defaultCacheTTL is twice the default REQ retry time, so that a cached
+// reply is still around when the first resend arrives.
+const defaultCacheTTL = time.Minute * 2
+
 func (r *rep) Init(sock pikago.ProtocolSocket) {
 	r.sock = sock
 	r.eps = make(map[uint32]*repEp)
 	r.backtracebuf = make([]byte, 64)
 	r.ttl = 8 // default specified in the RFC
+	r.cacheTTL = defaultCacheTTL
+	r.fq.Init(sock, 2)
 	r.w.Init()
 	r.sock.SetSendError(pikago.ErrProtoState)
 	r.w.Add()
@@ -53,30 +60,13 @@ func (r *rep) Shutdown(expire time.Time) {
 
 	for id, peer := range peers {
 		delete(peers, id)
-		pikago.DrainChannel(peer.q, expire)
-		close(peer.q)
-	}
-}
-
-func (pe *repEp) sender() {
-	for {
-		m := <-pe.q
-		if m == nil {
-			break
-		}
-
-		if pe.ep.SendMsg(m) != nil {
-			m.Free()
-			break
-		}
+		peer.q.Drain(expire)
+		peer.q.Close()
 	}
 }
 
 func (r *rep) receiver(ep pikago.Endpoint) {
 
-	rq := r.sock.RecvChannel()
-	cq := r.sock.CloseChannel()
-
 	for {
 
 		m := ep.RecvMsg()
@@ -84,39 +74,59 @@ func (r *rep) receiver(ep pikago.Endpoint) {
 			return
 		}
 
-		v := ep.GetID()
-		m.Header = append(m.Header,
-			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		m.AppendHeaderUint32(ep.GetID())
 
-		hops := 0
 		// Move backtrace from body to header.
-		for {
-			if hops >= r.ttl {
-				m.Free() // ErrTooManyHops
-				return
-			}
-			hops++
-			if len(m.Body) < 4 {
-				m.Free() // ErrGarbled
-				return
-			}
-			m.Header = append(m.Header, m.Body[:4]...)
-			m.Body = m.Body[4:]
-			// Check for high order bit set (0x80000000, big endian)
-			if m.Header[len(m.Header)-4]&0x80 != 0 {
-				break
-			}
+		bt, body, err := pikago.SplitBacktrace(m.Body, r.ttl)
+		if err != nil {
+			m.Free() // ErrTooManyHops or ErrGarbled
+			return
 		}
+		m.Header = append(m.Header, bt...)
+		m.Body = body
 
-		select {
-		case rq <- m:
-		case <-cq:
+		if r.replayed(ep, m) {
+			continue
+		}
+
+		if !r.fq.Put(ep, m) {
 			m.Free()
 			return
 		}
 	}
 }
 
+// replayed checks a request against the reply cache.  A request seen
+// before is consumed here: if its reply is cached, the reply is sent
+// again, otherwise the application is still working on it and the
+// duplicate is dropped.  New requests are recorded as pending.
+func (r *rep) replayed(ep pikago.Endpoint, m *pikago.Message) bool {
+	r.Lock()
+	if r.cache == nil {
+		r.Unlock()
+		return false
+	}
+	key := string(m.Header)
+	reply, seen := r.cache.lookup(key)
+	if !seen {
+		r.cache.pending(key)
+		r.Unlock()
+		return false
+	}
+	m.Free()
+	if reply == nil {
+		r.Unlock()
+		return true
+	}
+	// A closed queue (peer removed or shutting down) refuses the reply.
+	pe := r.eps[ep.GetID()]
+	if pe == nil || !pe.q.TryPut(reply) {
+		reply.Free()
+	}
+	r.Unlock()
+	return true
+}
+
 func (r *rep) sender() {
 	defer r.w.Done()
 	cq := r.sock.CloseChannel()
@@ -135,24 +145,37 @@ func (r *rep) sender() {
 			return
 		}
 
-		// Lop off the 32-bit peer/pipe ID.  If absent, drop.
-		if len(m.Header) < 4 {
+		// Lop off the 32-bit peer/pipe ID.  If absent, drop.  With
+		// SendTo the header holds only the rest of the backtrace.
+		// Popping edits the header, so work on a private copy.
+		m = m.Writable()
+		var id uint32
+		if ep := m.Target(); ep != nil {
+			id = ep.GetID()
+		} else if v, err := m.PopHeaderUint32(); err == nil {
+			id = v
+		} else {
 			m.Free()
 			continue
 		}
-		id := binary.BigEndian.Uint32(m.Header)
-		m.Header = m.Header[4:]
+		var pid [4]byte
+		binary.BigEndian.PutUint32(pid[:], id)
+		key := string(pid[:]) + string(m.Header)
 		r.Lock()
 		pe := r.eps[id]
+		if r.cache != nil {
+			c := pikago.NewMessage(len(m.Body))
+			c.Header = append(c.Header, m.Header...)
+			c.Body = append(c.Body, m.Body...)
+			r.cache.store(key, c)
+		}
 		r.Unlock()
 		if pe == nil {
 			m.Free()
 			continue
 		}
 
-		select {
-		case pe.q <- m:
-		default:
+		if !pe.q.TryPut(m) {
 			// If our queue is full, we have no choice but to
 			// throw it on the floor.  This shoudn't happen,
 			// since each partner should be running synchronously.
@@ -165,6 +188,12 @@ func (r *rep) sender() {
 	}
 }
 
+// CanSendTo implements ProtocolTargeter; only raw sockets, which route
+// by backtrace, can address a peer.
+func (r *rep) CanSendTo() bool {
+	return r.raw
+}
+
 func (*rep) Number() uint16 {
 	return pikago.ProtoRep
 }
@@ -182,13 +211,12 @@ func (*rep) PeerName() string {
 }
 
 func (r *rep) AddEndpoint(ep pikago.Endpoint) {
-	pe := &repEp{ep: ep, r: r, q: make(chan *pikago.Message, 2)}
-	pe.w.Init()
+	pe := &repEp{ep: ep, q: pikago.NewOutbox(ep, 2)}
 	r.Lock()
 	r.eps[ep.GetID()] = pe
 	r.Unlock()
+	r.fq.Add(ep)
 	go r.receiver(ep)
-	go pe.sender()
 }
 
 func (r *rep) RemoveEndpoint(ep pikago.Endpoint) {
@@ -198,9 +226,10 @@ func (r *rep) RemoveEndpoint(ep pikago.Endpoint) {
 	pe := r.eps[id]
 	delete(r.eps, id)
 	r.Unlock()
+	r.fq.Remove(ep)
 
 	if pe != nil {
-		close(pe.q)
+		pe.q.Close()
 	}
 }
 
@@ -214,9 +243,23 @@ func (r *rep) RecvHook(m *pikago.Message) bool {
 	}
 	r.sock.SetSendError(nil)
 	r.backtraceL.Lock()
+	// A request still held here was dropped by the application, which
+	// moved on without replying.
+	var dropped string
+	if r.backtrace != nil {
+		dropped = string(r.backtrace)
+	}
 	r.backtrace = append(r.backtracebuf[0:0], m.Header...)
 	r.backtraceL.Unlock()
 	m.Header = nil
+
+	if dropped != "" {
+		r.Lock()
+		if r.cache != nil {
+			r.cache.forget(dropped)
+		}
+		r.Unlock()
+	}
 	return true
 }
 
@@ -252,13 +295,31 @@ func (r *rep) SetOption(name string, v interface{}) error {
 		}
 		return nil
 	case pikago.OptionTTL:
-		if ttl, ok := v.(int); !ok {
+		ttl, ok := v.(int)
+		if !ok || ttl < 1 || ttl > 255 {
 			return pikago.ErrBadValue
-		} else if ttl < 1 || ttl > 255 {
+		}
+		r.ttl = ttl
+		return nil
+	case pikago.OptionReplyCacheSize:
+		size, ok := v.(int)
+		if !ok || size < 0 {
 			return pikago.ErrBadValue
-		} else {
-			r.ttl = ttl
 		}
+		r.Lock()
+		r.cacheSize = size
+		r.resetCache()
+		r.Unlock()
+		return nil
+	case pikago.OptionReplyCacheTTL:
+		d, ok := v.(time.Duration)
+		if !ok || d <= 0 {
+			return pikago.ErrBadValue
+		}
+		r.Lock()
+		r.cacheTTL = d
+		r.resetCache()
+		r.Unlock()
 		return nil
 	default:
 		return pikago.ErrBadOption
@@ -271,11 +332,31 @@ func (r *rep) GetOption(name string) (interface{}, error) {
 		return r.raw, nil
 	case pikago.OptionTTL:
 		return r.ttl, nil
+	case pikago.OptionReplyCacheSize:
+		r.Lock()
+		defer r.Unlock()
+		return r.cacheSize, nil
+	case pikago.OptionReplyCacheTTL:
+		r.Lock()
+		defer r.Unlock()
+		return r.cacheTTL, nil
 	default:
 		return nil, pikago.ErrBadOption
 	}
 }
 
+// resetCache replaces the reply cache after its settings changed.
+// The caller must hold the lock.
+func (r *rep) resetCache() {
+	if r.cache != nil {
+		r.cache.flush()
+		r.cache = nil
+	}
+	if r.cacheSize > 0 {
+		r.cache = newReplyCache(r.cacheSize, r.cacheTTL)
+	}
+}
+
 // NewSocket allocates a new Socket using the REP protocol.
 func NewSocket() (pikago.Socket, error) {
 	return pikago.MakeSocket(&rep{}), nil
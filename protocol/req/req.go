@@ -3,7 +3,6 @@
 package req
 
 import (
-	"encoding/binary"
 	"sync"
 	"time"
 
@@ -14,33 +13,51 @@ import (
 type req struct {
 	sync.Mutex
 	sock   pikago.ProtocolSocket
-	eps    map[uint32]*reqEp
 	resend chan *pikago.Message
 	raw    bool
 	retry  time.Duration
 	nextid uint32
 	waker  *time.Timer
 	w      pikago.Waiter
+	d      pikago.Dispatcher
 	init   sync.Once
 
+	maxretry int            // resends before giving up, 0 is unlimited
+	ejectN   int            // consecutive timeouts that eject a peer
+	ejectT   time.Duration  // how long an ejected peer is skipped
+	fails    map[uint32]int // consecutive timeouts, by peer
+	hedge    time.Duration  // delay before hedging, 0 is disabled
+	hedges   int            // hedged requests sent
+	hedgewin int            // hedged requests answered by the hedge peer
+
 	// fields describing the outstanding request
-	reqmsg *pikago.Message
-	reqid  uint32
+	reqmsg  *pikago.Message
+	reqid   uint32
+	retries int             // resends so far
+	reqep   pikago.Endpoint // peer the request was last sent to
+	tried   map[uint32]bool // peers the request was sent to
+	hedger  *time.Timer     // fires the hedge for the request
+	hedgeep pikago.Endpoint // peer the hedge was sent to
 }
 
-type reqEp struct {
-	ep pikago.Endpoint
-	cq chan struct{}
-}
+const defaultEjectTime = time.Second * 30
+
+// resendQLen is the depth of the resend queue.  Requests that failed on
+// one peer wait there for another, so it must hold one per failing peer
+// without blocking the Dispatcher.
+const resendQLen = 16
 
 func (r *req) Init(socket pikago.ProtocolSocket) {
 	r.sock = socket
-	r.eps = make(map[uint32]*reqEp)
-	r.resend = make(chan *pikago.Message)
+	r.resend = make(chan *pikago.Message, resendQLen)
 	r.w.Init()
+	r.d.Init(r.failed)
 
 	r.nextid = uint32(time.Now().UnixNano()) // quasi-random
 	r.retry = time.Minute * 1                // retry after a minute
+	r.ejectT = defaultEjectTime
+	r.fails = make(map[uint32]int)
+	r.tried = make(map[uint32]bool)
 	r.waker = time.NewTimer(r.retry)
 	r.waker.Stop()
 	r.sock.SetRecvError(pikago.ErrProtoState)
@@ -48,6 +65,7 @@ func (r *req) Init(socket pikago.ProtocolSocket) {
 
 func (r *req) Shutdown(expire time.Time) {
 	r.w.WaitAbsTimeout(expire)
+	r.d.Drain(expire)
 }
 
 // nextID returns the next request ID.
@@ -60,6 +78,9 @@ func (r *req) nextID() uint32 {
 }
 
 // resend sends the request message again, after a timer has expired.
+// The peer that timed out is charged with a failure, and ejected for a
+// while once it has failed too often in a row.  After the configured
+// number of retries the request fails instead.
 func (r *req) resender() {
 
 	defer r.w.Done()
@@ -78,10 +99,42 @@ func (r *req) resender() {
 			r.Unlock()
 			continue
 		}
-		m = m.Dup()
+		eject := r.reqep
+		if eject != nil {
+			id := eject.GetID()
+			r.fails[id]++
+			if r.ejectN > 0 && r.fails[id] >= r.ejectN {
+				delete(r.fails, id)
+			} else {
+				eject = nil
+			}
+		}
+		r.reqep = nil
+		ejectT := r.ejectT
+		if r.maxretry > 0 && r.retries >= r.maxretry {
+			r.reqmsg = nil
+			m.Free()
+			r.sock.SetRecvError(pikago.ErrRequestFailed)
+			m = nil
+		} else {
+			r.retries++
+			m = m.Dup()
+		}
 		r.Unlock()
 
-		r.resend <- m
+		if eject != nil {
+			r.d.Eject(eject, ejectT)
+		}
+		if m == nil {
+			continue
+		}
+
+		select {
+		case r.resend <- m:
+		case <-cq:
+			m.Free()
+			return
+		}
 		r.Lock()
 		if r.retry > 0 {
 			r.waker.Reset(r.retry)
@@ -118,36 +171,114 @@ func (r *req) receiver(ep pikago.Endpoint) {
 	}
 }
 
-func (r *req) sender(pe *reqEp) {
-
-	// NB: Because this function is only called when an endpoint is
-	// added, we can reasonably safely cache the channels -- they won't
-	// be changing after this point.
-
+// sender hands each request to the peer with the best send priority
+// that has room in its send queue.  Lower priority peers only see
+// traffic when every higher priority peer has a full queue or is gone.
+func (r *req) sender() {
 	defer r.w.Done()
 	sq := r.sock.SendChannel()
 	cq := r.sock.CloseChannel()
-	rq := r.resend
 
 	for {
 		var m *pikago.Message
 
 		select {
-		case m = <-rq:
+		case m = <-r.resend:
 		case m = <-sq:
+			if m == nil {
+				sq = r.sock.SendChannel()
+				continue
+			}
 		case <-cq:
 			return
-		case <-pe.cq:
-			return
 		}
 
-		if pe.ep.SendMsg(m) != nil {
-			r.resend <- m
-			break
+		if !r.sendRequest(m, cq) {
+			m.Free()
+			return
 		}
 	}
 }
 
+// sendRequest dispatches a message.  If it is the outstanding request
+// being resent, peers it was already sent to are avoided, and the peer
+// chosen is remembered so a timeout can be charged to it.
+func (r *req) sendRequest(m *pikago.Message, cq <-chan struct{}) bool {
+	r.Lock()
+	last, ok := pikago.Backtrace(m.Header).Last()
+	current := !r.raw && r.reqmsg != nil && ok && last == r.reqid
+	if !current {
+		r.Unlock()
+		return r.d.Send(m, cq) != nil
+	}
+	id := r.reqid
+	tried := make(map[uint32]bool, len(r.tried))
+	for k := range r.tried {
+		tried[k] = true
+	}
+	r.Unlock()
+
+	ep := r.d.SendExcept(m, func(ep pikago.Endpoint) bool {
+		return tried[ep.GetID()]
+	}, cq)
+	if ep == nil {
+		return false
+	}
+
+	r.Lock()
+	if r.reqmsg != nil && r.reqid == id {
+		r.reqep = ep
+		r.tried[ep.GetID()] = true
+	}
+	r.Unlock()
+	return true
+}
+
+// failed is called when a peer could not send a request; try another.
+// It must not wait for the sender, which may itself be blocked in the
+// Dispatcher waiting for an idle peer.  If the resend queue is full the
+// message is dropped; a cooked request is still resent by its timer.
+func (r *req) failed(ep pikago.Endpoint, m *pikago.Message) {
+	select {
+	case r.resend <- m:
+	default:
+		m.Free()
+	}
+}
+
+// hedgeRequest sends a copy of the outstanding request to a peer that
+// has not seen it yet, if one is idle.  Whichever reply comes first is
+// returned; the other is discarded by RecvHook as stale.
+func (r *req) hedgeRequest(id uint32) {
+	r.Lock()
+	if r.reqmsg == nil || r.reqid != id || r.hedgeep != nil {
+		r.Unlock()
+		return
+	}
+	m := r.reqmsg.Dup()
+	tried := make(map[uint32]bool, len(r.tried))
+	for k := range r.tried {
+		tried[k] = true
+	}
+	r.Unlock()
+
+	ep := r.d.TrySendExcept(m, func(ep pikago.Endpoint) bool {
+		return tried[ep.GetID()]
+	})
+	if ep == nil {
+		m.Free()
+		return
+	}
+
+	r.Lock()
+	r.hedges++
+	if r.reqmsg != nil && r.reqid == id {
+		r.hedgeep = ep
+		r.tried[ep.GetID()] = true
+	}
+	r.Unlock()
+}
+
 func (*req) Number() uint16 {
 	return pikago.ProtoReq
 }
@@ -169,26 +300,19 @@ func (r *req) AddEndpoint(ep pikago.Endpoint) {
 	r.init.Do(func() {
 		r.w.Add()
 		go r.resender()
+		r.w.Add()
+		go r.sender()
 	})
 
-	pe := &reqEp{cq: make(chan struct{}), ep: ep}
-	r.Lock()
-	r.eps[ep.GetID()] = pe
-	r.Unlock()
+	r.d.Add(ep)
 	go r.receiver(ep)
-	r.w.Add()
-	go r.sender(pe)
 }
 
 func (r *req) RemoveEndpoint(ep pikago.Endpoint) {
-	id := ep.GetID()
+	r.d.Remove(ep)
 	r.Lock()
-	pe := r.eps[id]
-	delete(r.eps, id)
+	delete(r.fails, ep.GetID())
 	r.Unlock()
-	if pe != nil {
-		close(pe.cq)
-	}
 }
 
 func (r *req) SendHook(m *pikago.Message) bool {
@@ -204,10 +328,22 @@ func (r *req) SendHook(m *pikago.Message) bool {
 	// We need to generate a new request id, and append it to the header.
 	r.reqid = r.nextID()
 	v := r.reqid
-	m.Header = append(m.Header,
-		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	m.AppendHeaderUint32(v)
 
 	r.reqmsg = m.Dup()
+	r.retries = 0
+	r.reqep = nil
+	r.hedgeep = nil
+	for id := range r.tried {
+		delete(r.tried, id)
+	}
+	if r.hedger != nil {
+		r.hedger.Stop()
+		r.hedger = nil
+	}
+	if r.hedge > 0 {
+		r.hedger = time.AfterFunc(r.hedge, func() { r.hedgeRequest(v) })
+	}
 
 	// Schedule a retry, in case we don't get a reply.
 	if r.retry > 0 {
@@ -228,18 +364,28 @@ func (r *req) RecvHook(m *pikago.Message) bool {
 	}
 	r.Lock()
 	defer r.Unlock()
-	if len(m.Header) < 4 {
-		return false
-	}
 	if r.reqmsg == nil {
 		return false
 	}
-	if binary.BigEndian.Uint32(m.Header) != r.reqid {
+	if id, err := m.PeekHeaderUint32(); err != nil || id != r.reqid {
 		return false
 	}
 	r.waker.Stop()
 	r.reqmsg.Free()
 	r.reqmsg = nil
+	r.reqep = nil
+	if r.hedger != nil {
+		r.hedger.Stop()
+		r.hedger = nil
+	}
+	if ep, ok := m.Port.(pikago.Endpoint); ok {
+		// The peer answered, so it is healthy again.
+		delete(r.fails, ep.GetID())
+		if r.hedgeep != nil && r.hedgeep.GetID() == ep.GetID() {
+			r.hedgewin++
+		}
+	}
+	r.hedgeep = nil
 	r.sock.SetRecvError(pikago.ErrProtoState)
 	return true
 }
@@ -265,6 +411,42 @@ func (r *req) SetOption(option string, value interface{}) error {
 			return pikago.ErrBadValue
 		}
 		return nil
+	case pikago.OptionMaxRetries:
+		n, ok := value.(int)
+		if !ok || n < 0 {
+			return pikago.ErrBadValue
+		}
+		r.Lock()
+		r.maxretry = n
+		r.Unlock()
+		return nil
+	case pikago.OptionEjectThreshold:
+		n, ok := value.(int)
+		if !ok || n < 0 {
+			return pikago.ErrBadValue
+		}
+		r.Lock()
+		r.ejectN = n
+		r.Unlock()
+		return nil
+	case pikago.OptionHedgeDelay:
+		d, ok := value.(time.Duration)
+		if !ok || d < 0 {
+			return pikago.ErrBadValue
+		}
+		r.Lock()
+		r.hedge = d
+		r.Unlock()
+		return nil
+	case pikago.OptionEjectTime:
+		d, ok := value.(time.Duration)
+		if !ok || d <= 0 {
+			return pikago.ErrBadValue
+		}
+		r.Lock()
+		r.ejectT = d
+		r.Unlock()
+		return nil
 	default:
 		return pikago.ErrBadOption
 	}
@@ -279,6 +461,30 @@ func (r *req) GetOption(option string) (interface{}, error) {
 		v := r.retry
 		r.Unlock()
 		return v, nil
+	case pikago.OptionMaxRetries:
+		r.Lock()
+		defer r.Unlock()
+		return r.maxretry, nil
+	case pikago.OptionEjectThreshold:
+		r.Lock()
+		defer r.Unlock()
+		return r.ejectN, nil
+	case pikago.OptionEjectTime:
+		r.Lock()
+		defer r.Unlock()
+		return r.ejectT, nil
+	case pikago.OptionHedgeDelay:
+		r.Lock()
+		defer r.Unlock()
+		return r.hedge, nil
+	case pikago.OptionHedgesSent:
+		r.Lock()
+		defer r.Unlock()
+		return r.hedges, nil
+	case pikago.OptionHedgesWon:
+		r.Lock()
+		defer r.Unlock()
+		return r.hedgewin, nil
 	default:
 		return nil, pikago.ErrBadOption
 	}
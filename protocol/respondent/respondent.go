@@ -3,7 +3,6 @@
 package respondent
 
 import (
-	"encoding/binary"
 	"sync"
 	"time"
 
@@ -18,11 +17,12 @@ type resp struct {
 	backbuf   []byte
 	backtrace []byte
 	w         pikago.Waiter
+	fq        pikago.FairQueue
 	sync.Mutex
 }
 
 type respPeer struct {
-	q  chan *pikago.Message
+	q  *pikago.Outbox
 	ep pikago.Endpoint
 	x  *resp
 }
@@ -32,6 +32,7 @@ func (x *resp) Init(sock pikago.ProtocolSocket) {
 	x.ttl = 8
 	x.peers = make(map[uint32]*respPeer)
 	x.w.Init()
+	x.fq.Init(sock, 2)
 	x.backbuf = make([]byte, 0, 64)
 	x.sock.SetSendError(pikago.ErrProtoState)
 	x.w.Add()
@@ -50,8 +51,8 @@ func (x *resp) Shutdown(expire time.Time) {
 
 	for id, peer := range peers {
 		delete(peers, id)
-		pikago.DrainChannel(peer.q, expire)
-		close(peer.q)
+		peer.q.Drain(expire)
+		peer.q.Close()
 	}
 }
 
@@ -74,15 +75,20 @@ func (x *resp) sender() {
 			return
 		}
 
-		// Lop off the 32-bit peer/pipe ID.  If absent, drop.
-		if len(m.Header) < 4 {
+		// Lop off the 32-bit peer/pipe ID.  If absent, drop.  With
+		// SendTo the header holds only the rest of the backtrace.
+		// Popping edits the header, so work on a private copy.
+		m = m.Writable()
+		var id uint32
+		if ep := m.Target(); ep != nil {
+			id = ep.GetID()
+		} else if v, err := m.PopHeaderUint32(); err == nil {
+			id = v
+		} else {
 			m.Free()
 			continue
 		}
 
-		id := binary.BigEndian.Uint32(m.Header)
-		m.Header = m.Header[4:]
-
 		x.Lock()
 		peer := x.peers[id]
 		x.Unlock()
@@ -93,66 +99,32 @@ func (x *resp) sender() {
 		}
 
 		// Put it on the outbound queue
-		select {
-		case peer.q <- m:
-		default:
+		if !peer.q.TryPut(m) {
 			// Backpressure, drop it.
 			m.Free()
 		}
 	}
 }
 
-// When sending, we should have the survey ID in the header.
-func (peer *respPeer) sender() {
-	for {
-		m := <-peer.q
-		if m == nil {
-			break
-		}
-		if peer.ep.SendMsg(m) != nil {
-			m.Free()
-			break
-		}
-	}
-}
-
 func (x *resp) receiver(ep pikago.Endpoint) {
 
-	rq := x.sock.RecvChannel()
-	cq := x.sock.CloseChannel()
-
-outer:
 	for {
 		m := ep.RecvMsg()
 		if m == nil {
 			return
 		}
 
-		v := ep.GetID()
-		m.Header = append(m.Header,
-			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
-		hops := 0
+		m.AppendHeaderUint32(ep.GetID())
 
-		for {
-			if hops >= x.ttl {
-				m.Free() // ErrTooManyHops
-				continue outer
-			}
-			hops++
-			if len(m.Body) < 4 {
-				m.Free()
-				continue outer
-			}
-			m.Header = append(m.Header, m.Body[:4]...)
-			m.Body = m.Body[4:]
-			if m.Header[len(m.Header)-4]&0x80 != 0 {
-				break
-			}
+		bt, body, err := pikago.SplitBacktrace(m.Body, x.ttl)
+		if err != nil {
+			m.Free() // ErrTooManyHops or ErrGarbled
+			continue
 		}
+		m.Header = append(m.Header, bt...)
+		m.Body = body
 
-		select {
-		case rq <- m:
-		case <-cq:
+		if !x.fq.Put(ep, m) {
 			m.Free()
 			return
 		}
@@ -194,14 +166,14 @@ func (x *resp) SendHook(m *pikago.Message) bool {
 }
 
 func (x *resp) AddEndpoint(ep pikago.Endpoint) {
-	peer := &respPeer{ep: ep, x: x, q: make(chan *pikago.Message, 1)}
+	peer := &respPeer{ep: ep, x: x, q: pikago.NewOutbox(ep, 1)}
 
 	x.Lock()
 	x.peers[ep.GetID()] = peer
 	x.Unlock()
 
+	x.fq.Add(ep)
 	go x.receiver(ep)
-	go peer.sender()
 }
 
 func (x *resp) RemoveEndpoint(ep pikago.Endpoint) {
@@ -211,12 +183,19 @@ func (x *resp) RemoveEndpoint(ep pikago.Endpoint) {
 	peer := x.peers[id]
 	delete(x.peers, id)
 	x.Unlock()
+	x.fq.Remove(ep)
 
 	if peer != nil {
-		close(peer.q)
+		peer.q.Close()
 	}
 }
 
+// CanSendTo implements ProtocolTargeter; only raw sockets, which route
+// by backtrace, can address a peer.
+func (x *resp) CanSendTo() bool {
+	return x.raw
+}
+
 func (*resp) Number() uint16 {
 	return pikago.ProtoRespondent
 }
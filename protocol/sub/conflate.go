@@ -0,0 +1,112 @@
+package sub
+
+import (
+	"sync"
+
+	"github.com/k4s/pikago"
+)
+
+// conflater keeps only the latest undelivered message for each key.
+// Keys are delivered in the order their first pending message arrived,
+// so a busy topic cannot starve the others.
+type conflater struct {
+	sock  pikago.ProtocolSocket
+	on    bool
+	keyf  pikago.KeyFunc
+	last  map[string]*pikago.Message
+	order []string
+	ready chan struct{}
+	init  sync.Once
+	sync.Mutex
+}
+
+func (c *conflater) Init(sock pikago.ProtocolSocket) {
+	c.sock = sock
+	c.last = make(map[string]*pikago.Message)
+	c.ready = make(chan struct{}, 1)
+}
+
+// start launches the pump.  It is called when the first endpoint is
+// added, after which the socket's read queue no longer changes.
+func (c *conflater) start() {
+	c.init.Do(func() {
+		go c.pump()
+	})
+}
+
+// put queues m under its key, replacing any older message with the same
+// key.  It returns false when conflation is off, leaving m with the
+// caller.  def is the key used when no key function is set or it
+// returns nil.  The key function is called without the lock held, so it
+// may use the socket.
+func (c *conflater) put(m *pikago.Message, def []byte) bool {
+	c.Lock()
+	on, keyf := c.on, c.keyf
+	c.Unlock()
+	if !on {
+		return false
+	}
+	key := def
+	if keyf != nil {
+		if k := keyf(m); k != nil {
+			key = k
+		}
+	}
+
+	c.Lock()
+	if old, ok := c.last[string(key)]; ok {
+		old.Free()
+	} else {
+		c.order = append(c.order, string(key))
+	}
+	c.last[string(key)] = m
+	c.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (c *conflater) pump() {
+	rq := c.sock.RecvChannel()
+	cq := c.sock.CloseChannel()
+
+	for {
+		c.Lock()
+		if len(c.order) == 0 {
+			c.Unlock()
+			select {
+			case <-c.ready:
+				continue
+			case <-cq:
+				c.flush()
+				return
+			}
+		}
+		key := c.order[0]
+		c.order = c.order[1:]
+		m := c.last[key]
+		delete(c.last, key)
+		c.Unlock()
+
+		select {
+		case rq <- m:
+		case <-cq:
+			m.Free()
+			c.flush()
+			return
+		}
+	}
+}
+
+func (c *conflater) flush() {
+	c.Lock()
+	for key, m := range c.last {
+		m.Free()
+		delete(c.last, key)
+	}
+	c.order = nil
+	c.Unlock()
+}
@@ -0,0 +1,116 @@
+package sub
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// Kinds of subscription filters, as reported in Subscription.Kind.
+const (
+	KindPrefix  = iota // OptionSubscribe: raw byte prefix of the body
+	KindPattern        // OptionSubscribePattern: segment pattern on the topic
+	KindRegexp         // OptionSubscribeRegexp: regular expression on the topic
+)
+
+// defaultSeparator splits topics into segments for pattern filters.
+const defaultSeparator = '.'
+
+// Subscription describes one active filter, as returned by
+// GetOption(pikago.OptionSubscriptions).
+type Subscription struct {
+	Kind   int
+	Filter string
+}
+
+// filter is a compiled pattern or regexp subscription.
+type filter struct {
+	kind int
+	src  string
+	segs []string       // pattern split on the separator
+	re   *regexp.Regexp // regexp filters only
+}
+
+// filterSet is an immutable snapshot of the pattern and regexp
+// subscriptions, replaced wholesale whenever they change.
+type filterSet struct {
+	sep  byte
+	list []*filter
+}
+
+func (f *filter) compile(sep byte) error {
+	if f.kind == KindRegexp {
+		re, err := regexp.Compile(f.src)
+		if err != nil {
+			return err
+		}
+		f.re = re
+		return nil
+	}
+	f.segs = strings.Split(f.src, string([]byte{sep}))
+	return nil
+}
+
+// match reports whether any filter in the set accepts the message body.
+func (fs *filterSet) match(body []byte) bool {
+	if fs == nil || len(fs.list) == 0 {
+		return false
+	}
+	t := topic(body)
+	var segs [][]byte
+	for _, f := range fs.list {
+		if f.re != nil {
+			if f.re.Match(t) {
+				return true
+			}
+			continue
+		}
+		if segs == nil {
+			segs = bytes.Split(t, []byte{fs.sep})
+		}
+		if matchSegs(f.segs, segs) {
+			return true
+		}
+	}
+	return false
+}
+
+// topic returns the leading part of the body up to the first space
+// or control character.
+func topic(body []byte) []byte {
+	for i, c := range body {
+		if c <= 0x20 {
+			return body[:i]
+		}
+	}
+	return body
+}
+
+// matchSegs matches topic segments against a pattern, where "*" matches
+// exactly one segment and "#" matches zero or more.
+func matchSegs(pat []string, segs [][]byte) bool {
+	for len(pat) > 0 {
+		switch p := pat[0]; p {
+		case "#":
+			if len(pat) == 1 {
+				return true
+			}
+			for i := 0; i <= len(segs); i++ {
+				if matchSegs(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(segs) == 0 {
+				return false
+			}
+		default:
+			if len(segs) == 0 || string(segs[0]) != p {
+				return false
+			}
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
@@ -0,0 +1,109 @@
+package sub
+
+import (
+	"sync"
+
+	"github.com/k4s/pikago"
+)
+
+// Control frames sent to a PUB that negotiated ExtPubFilter.  The first
+// body byte is the operation, the rest is the prefix.
+const (
+	ctlUnsubscribe = 0
+	ctlSubscribe   = 1
+)
+
+// fwdPeer forwards subscription changes to one PUB peer, in order and
+// without blocking SetOption.
+type fwdPeer struct {
+	ep   pikago.Endpoint
+	q    []*pikago.Message
+	wake chan struct{}
+	cq   chan struct{}
+	sync.Mutex
+}
+
+func newFwdPeer(ep pikago.Endpoint) *fwdPeer {
+	return &fwdPeer{
+		ep:   ep,
+		wake: make(chan struct{}, 1),
+		cq:   make(chan struct{}),
+	}
+}
+
+// post queues a control frame for the peer.
+func (fp *fwdPeer) post(op byte, prefix []byte) {
+	m := pikago.NewMessage(len(prefix) + 1)
+	m.Body = append(m.Body, op)
+	m.Body = append(m.Body, prefix...)
+	fp.Lock()
+	fp.q = append(fp.q, m)
+	fp.Unlock()
+	select {
+	case fp.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (fp *fwdPeer) sender() {
+	for {
+		fp.Lock()
+		q := fp.q
+		fp.q = nil
+		fp.Unlock()
+
+		for i, m := range q {
+			if fp.ep.SendMsg(m) != nil {
+				m.Free()
+				for _, m := range q[i+1:] {
+					m.Free()
+				}
+				return
+			}
+		}
+
+		select {
+		case <-fp.wake:
+		case <-fp.cq:
+			fp.Lock()
+			for _, m := range fp.q {
+				m.Free()
+			}
+			fp.q = nil
+			fp.Unlock()
+			return
+		}
+	}
+}
+
+// forwarding reports whether the peer negotiated publisher filtering.
+func forwarding(ep pikago.Endpoint) bool {
+	v, err := ep.GetProp(pikago.PropExtensions)
+	return err == nil && v.(uint16)&pikago.ExtPubFilter != 0
+}
+
+// forward sends a subscription change to every filtering peer.  The
+// caller must hold the lock.
+func (s *sub) forward(op byte, prefix []byte) {
+	for _, fp := range s.fwd {
+		fp.post(op, prefix)
+	}
+}
+
+// catchAll reports whether the PUB must send everything because some
+// filter cannot be expressed as a prefix.  The caller must hold the lock.
+func (s *sub) catchAll() bool {
+	return len(s.pats) > 0
+}
+
+// forwardAll sends the current subscriptions to a new peer.  The caller
+// must hold the lock.
+func (s *sub) forwardAll(fp *fwdPeer) {
+	list := s.subs.List()
+	if s.catchAll() && s.subs.Longest(nil) != 0 {
+		list = append(list, nil)
+	}
+	for _, p := range list {
+		fp.post(ctlSubscribe, p)
+	}
+}
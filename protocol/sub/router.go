@@ -0,0 +1,118 @@
+package sub
+
+import (
+	"sync"
+
+	"github.com/k4s/pikago"
+)
+
+// Handler handles one message received by a Router.  The Router frees
+// the message when the handler returns, so a handler that keeps it must
+// take a Dup.
+type Handler func(*pikago.Message)
+
+// Router runs the receive loop of a SUB socket and dispatches each
+// message to the handler registered for the longest prefix of its body.
+// Registering a handler subscribes to its prefix, and removing it
+// unsubscribes again.
+type Router struct {
+	sock     pikago.Socket
+	prefixes pikago.PrefixSet
+	handlers map[string]Handler
+	workers  int
+	sync.Mutex
+}
+
+// NewRouter returns a Router for the given SUB socket.  With workers > 0
+// handlers run on that many goroutines, and messages on the same topic
+// may then be handled out of order; otherwise they run one at a time on
+// the goroutine calling Run.
+func NewRouter(sock pikago.Socket, workers int) *Router {
+	return &Router{
+		sock:     sock,
+		handlers: make(map[string]Handler),
+		workers:  workers,
+	}
+}
+
+// Handle registers h for messages starting with prefix, replacing any
+// handler already registered for it.  An empty prefix catches every
+// message not claimed by a longer prefix.
+func (r *Router) Handle(prefix string, h Handler) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.handlers[prefix]; !ok {
+		if err := r.sock.SetOption(pikago.OptionSubscribe, prefix); err != nil {
+			return err
+		}
+		r.prefixes.Add([]byte(prefix))
+	}
+	r.handlers[prefix] = h
+	return nil
+}
+
+// Remove unregisters the handler for prefix and unsubscribes from it.
+// It returns ErrBadValue if no handler is registered.
+func (r *Router) Remove(prefix string) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.handlers[prefix]; !ok {
+		return pikago.ErrBadValue
+	}
+	delete(r.handlers, prefix)
+	r.prefixes.Remove([]byte(prefix))
+	return r.sock.SetOption(pikago.OptionUnsubscribe, prefix)
+}
+
+// Run receives and dispatches messages until the socket is closed, and
+// then returns ErrClosed.  Receive timeouts are ignored.  When using a
+// worker pool, Run waits for in-flight handlers before returning.
+func (r *Router) Run() error {
+	var wg sync.WaitGroup
+	var work chan *pikago.Message
+	if r.workers > 0 {
+		work = make(chan *pikago.Message, r.workers)
+		for i := 0; i < r.workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for m := range work {
+					r.dispatch(m)
+				}
+			}()
+		}
+		defer wg.Wait()
+		defer close(work)
+	}
+
+	for {
+		m, err := r.sock.RecvMsg()
+		switch err {
+		case nil:
+		case pikago.ErrRecvTimeout:
+			continue
+		default:
+			return err
+		}
+		if work != nil {
+			work <- m
+		} else {
+			r.dispatch(m)
+		}
+	}
+}
+
+func (r *Router) dispatch(m *pikago.Message) {
+	var h Handler
+	if n := r.prefixes.Longest(m.Body); n >= 0 {
+		r.Lock()
+		h = r.handlers[string(m.Body[:n])]
+		r.Unlock()
+	}
+	// The message may match a subscription made outside the Router, or
+	// one whose handler was just removed.
+	if h != nil {
+		h(m)
+	}
+	m.Free()
+}
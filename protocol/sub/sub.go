@@ -1,23 +1,40 @@
 package sub
 
 import (
-	"bytes"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/k4s/pikago"
 )
 
+// subQLen is the depth of each peer's queue, the same as the default
+// read queue.
+const subQLen = 128
+
 type sub struct {
 	sock pikago.ProtocolSocket
-	subs [][]byte
+	subs pikago.PrefixSet
+	pats []*filter
+	sep  byte
+	fset atomic.Value // *filterSet
 	raw  bool
+	fq   pikago.FairQueue
+	cf   conflater
+	pf   bool                // OptionPublisherFilter
+	fwd  map[uint32]*fwdPeer // peers that filter at the PUB
 	sync.Mutex
 }
 
 func (s *sub) Init(sock pikago.ProtocolSocket) {
 	s.sock = sock
-	s.subs = [][]byte{}
+	s.sep = defaultSeparator
+	s.fset.Store((*filterSet)(nil))
+	// Messages are dropped when a peer's queue is full, so make it deep
+	// enough that bursts only suffer once the application falls behind.
+	s.fq.Init(sock, subQLen)
+	s.cf.Init(sock)
+	s.fwd = make(map[uint32]*fwdPeer)
 	s.sock.SetSendError(pikago.ErrProtoOp)
 }
 
@@ -25,38 +42,39 @@ func (*sub) Shutdown(time.Time) {} // No sender to drain.
 
 func (s *sub) receiver(ep pikago.Endpoint) {
 
-	rq := s.sock.RecvChannel()
-	cq := s.sock.CloseChannel()
-
 	for {
-		var matched = false
-
 		m := ep.RecvMsg()
 		if m == nil {
 			return
 		}
 
-		s.Lock()
-		for _, sub := range s.subs {
-			if bytes.HasPrefix(m.Body, sub) {
-				// Matched, send it up.  Best effort.
-				matched = true
-				break
-			}
+		// The subscription trie is immutable once published, so
+		// matching needs no lock and costs O(len(topic)).
+		// Pattern and regexp filters are likewise read from an
+		// immutable snapshot.
+		// The empty prefix (subscribe to all) would put every topic
+		// under one conflation key, so it uses the topic instead.
+		var key []byte
+		if n := s.subs.Longest(m.Body); n > 0 {
+			key = m.Body[:n]
+		} else if n == 0 {
+			key = topic(m.Body)
+		} else if s.filters().match(m.Body) {
+			key = topic(m.Body)
+		} else {
+			m.Free()
+			continue
 		}
-		s.Unlock()
 
-		if !matched {
-			m.Free()
+		// With conflation on, only the latest message per topic
+		// waits for the application.
+		if s.cf.put(m, key) {
 			continue
 		}
 
-		select {
-		case rq <- m:
-		case <-cq:
-			m.Free()
-			return
-		default: // no room, drop it
+		// Best effort: if this peer already has messages waiting, the
+		// application is behind, so drop it.
+		if !s.fq.TryPut(ep, m) {
 			m.Free()
 		}
 	}
@@ -78,11 +96,40 @@ func (*sub) PeerName() string {
 	return "pub"
 }
 
+// Extensions offers publisher filtering when OptionPublisherFilter is set.
+func (s *sub) Extensions() uint16 {
+	s.Lock()
+	defer s.Unlock()
+	if s.pf {
+		return pikago.ExtPubFilter
+	}
+	return 0
+}
+
 func (s *sub) AddEndpoint(ep pikago.Endpoint) {
+	s.fq.Add(ep)
+	s.cf.start()
+	if forwarding(ep) {
+		fp := newFwdPeer(ep)
+		s.Lock()
+		s.fwd[ep.GetID()] = fp
+		s.forwardAll(fp)
+		s.Unlock()
+		go fp.sender()
+	}
 	go s.receiver(ep)
 }
 
-func (*sub) RemoveEndpoint(pikago.Endpoint) {}
+func (s *sub) RemoveEndpoint(ep pikago.Endpoint) {
+	s.fq.Remove(ep)
+	s.Lock()
+	fp := s.fwd[ep.GetID()]
+	delete(s.fwd, ep.GetID())
+	s.Unlock()
+	if fp != nil {
+		close(fp.cq)
+	}
+}
 
 func (s *sub) SetOption(name string, value interface{}) error {
 	s.Lock()
@@ -99,8 +146,63 @@ func (s *sub) SetOption(name string, value interface{}) error {
 			return pikago.ErrBadValue
 		}
 		return nil
+	case pikago.OptionTopicSeparator:
+		var sep byte
+		switch v := value.(type) {
+		case byte:
+			sep = v
+		case string:
+			if len(v) != 1 {
+				return pikago.ErrBadValue
+			}
+			sep = v[0]
+		default:
+			return pikago.ErrBadValue
+		}
+		// The topic ends at the first space or control character, so
+		// such a separator could never appear inside one.
+		if sep <= 0x20 {
+			return pikago.ErrBadValue
+		}
+		s.sep = sep
+		for _, f := range s.pats {
+			f.compile(s.sep)
+		}
+		s.publish()
+		return nil
+	case pikago.OptionConflate:
+		on, ok := value.(bool)
+		if !ok {
+			return pikago.ErrBadValue
+		}
+		s.cf.Lock()
+		s.cf.on = on
+		s.cf.Unlock()
+		return nil
+	case pikago.OptionConflateKey:
+		var keyf pikago.KeyFunc
+		switch f := value.(type) {
+		case pikago.KeyFunc:
+			keyf = f
+		case func(*pikago.Message) []byte:
+			keyf = f
+		case nil:
+		default:
+			return pikago.ErrBadValue
+		}
+		s.cf.Lock()
+		s.cf.keyf = keyf
+		s.cf.Unlock()
+		return nil
+	case pikago.OptionPublisherFilter:
+		if s.pf, ok = value.(bool); !ok {
+			return pikago.ErrBadValue
+		}
+		return nil
 	case pikago.OptionSubscribe:
 	case pikago.OptionUnsubscribe:
+	case pikago.OptionSubscribePattern, pikago.OptionSubscribeRegexp:
+	case pikago.OptionUnsubscribePattern, pikago.OptionUnsubscribeRegexp:
 	default:
 		return pikago.ErrBadOption
 	}
@@ -115,35 +217,125 @@ func (s *sub) SetOption(name string, value interface{}) error {
 	}
 	switch name {
 	case pikago.OptionSubscribe:
-		for _, sub := range s.subs {
-			if bytes.Equal(sub, vb) {
-				// Already present
-				return nil
-			}
+		// Already present is not an error.  The empty prefix is
+		// already forwarded while pattern filters exist.
+		if s.subs.Add(vb) && !(len(vb) == 0 && s.catchAll()) {
+			s.forward(ctlSubscribe, vb)
 		}
-		s.subs = append(s.subs, vb)
 		return nil
 
 	case pikago.OptionUnsubscribe:
-		for i, sub := range s.subs {
-			if bytes.Equal(sub, vb) {
-				s.subs[i] = s.subs[len(s.subs)-1]
-				s.subs = s.subs[:len(s.subs)-1]
-				return nil
-			}
+		if !s.subs.Remove(vb) {
+			// Subscription not present
+			return pikago.ErrBadValue
 		}
-		// Subscription not present
-		return pikago.ErrBadValue
+		if !(len(vb) == 0 && s.catchAll()) {
+			s.forward(ctlUnsubscribe, vb)
+		}
+		return nil
+
+	case pikago.OptionSubscribePattern:
+		return s.addFilter(KindPattern, string(vb))
+
+	case pikago.OptionSubscribeRegexp:
+		return s.addFilter(KindRegexp, string(vb))
+
+	case pikago.OptionUnsubscribePattern:
+		return s.removeFilter(KindPattern, string(vb))
+
+	case pikago.OptionUnsubscribeRegexp:
+		return s.removeFilter(KindRegexp, string(vb))
 
 	default:
 		return pikago.ErrBadOption
 	}
 }
 
+func (s *sub) filters() *filterSet {
+	return s.fset.Load().(*filterSet)
+}
+
+// publish replaces the filter snapshot used by the receivers.  The
+// caller must hold the lock.
+func (s *sub) publish() {
+	if len(s.pats) == 0 {
+		s.fset.Store((*filterSet)(nil))
+		return
+	}
+	fs := &filterSet{sep: s.sep}
+	for _, f := range s.pats {
+		c := *f
+		fs.list = append(fs.list, &c)
+	}
+	s.fset.Store(fs)
+}
+
+func (s *sub) addFilter(kind int, src string) error {
+	for _, f := range s.pats {
+		if f.kind == kind && f.src == src {
+			// Already present
+			return nil
+		}
+	}
+	f := &filter{kind: kind, src: src}
+	if err := f.compile(s.sep); err != nil {
+		return pikago.ErrBadValue
+	}
+	// The PUB cannot evaluate patterns, so ask it for everything.
+	if !s.catchAll() && s.subs.Longest(nil) != 0 {
+		s.forward(ctlSubscribe, nil)
+	}
+	s.pats = append(s.pats, f)
+	s.publish()
+	return nil
+}
+
+func (s *sub) removeFilter(kind int, src string) error {
+	for i, f := range s.pats {
+		if f.kind == kind && f.src == src {
+			s.pats = append(s.pats[:i], s.pats[i+1:]...)
+			s.publish()
+			if !s.catchAll() && s.subs.Longest(nil) != 0 {
+				s.forward(ctlUnsubscribe, nil)
+			}
+			return nil
+		}
+	}
+	// Subscription not present
+	return pikago.ErrBadValue
+}
+
 func (s *sub) GetOption(name string) (interface{}, error) {
 	switch name {
 	case pikago.OptionRaw:
 		return s.raw, nil
+	case pikago.OptionConflate:
+		s.cf.Lock()
+		defer s.cf.Unlock()
+		return s.cf.on, nil
+	case pikago.OptionConflateKey:
+		s.cf.Lock()
+		defer s.cf.Unlock()
+		return s.cf.keyf, nil
+	case pikago.OptionTopicSeparator:
+		s.Lock()
+		defer s.Unlock()
+		return s.sep, nil
+	case pikago.OptionPublisherFilter:
+		s.Lock()
+		defer s.Unlock()
+		return s.pf, nil
+	case pikago.OptionSubscriptions:
+		s.Lock()
+		defer s.Unlock()
+		var list []Subscription
+		for _, p := range s.subs.List() {
+			list = append(list, Subscription{Kind: KindPrefix, Filter: string(p)})
+		}
+		for _, f := range s.pats {
+			list = append(list, Subscription{Kind: f.kind, Filter: f.src})
+		}
+		return list, nil
 	default:
 		return nil, pikago.ErrBadOption
 	}
@@ -3,7 +3,6 @@
 package surveyor
 
 import (
-	"encoding/binary"
 	"sync"
 	"time"
 
@@ -29,7 +28,7 @@ type surveyor struct {
 }
 
 type surveyorP struct {
-	q  chan *pikago.Message
+	q  *pikago.Outbox
 	ep pikago.Endpoint
 	x  *surveyor
 }
@@ -56,8 +55,8 @@ func (x *surveyor) Shutdown(expire time.Time) {
 
 	for id, peer := range peers {
 		delete(peers, id)
-		pikago.DrainChannel(peer.q, expire)
-		close(peer.q)
+		peer.q.Drain(expire)
+		peer.q.Close()
 	}
 }
 
@@ -80,9 +79,7 @@ func (x *surveyor) sender() {
 		x.Lock()
 		for _, pe := range x.peers {
 			m := m.Dup()
-			select {
-			case pe.q <- m:
-			default:
+			if !pe.q.TryPut(m) {
 				m.Free()
 			}
 		}
@@ -90,20 +87,6 @@ func (x *surveyor) sender() {
 	}
 }
 
-// When sending, we should have the survey ID in the header.
-func (peer *surveyorP) sender() {
-	for {
-		if m := <-peer.q; m == nil {
-			break
-		} else {
-			if peer.ep.SendMsg(m) != nil {
-				m.Free()
-				return
-			}
-		}
-	}
-}
-
 func (peer *surveyorP) receiver() {
 
 	rq := peer.x.sock.RecvChannel()
@@ -133,11 +116,10 @@ func (peer *surveyorP) receiver() {
 }
 
 func (x *surveyor) AddEndpoint(ep pikago.Endpoint) {
-	peer := &surveyorP{ep: ep, x: x, q: make(chan *pikago.Message, 1)}
+	peer := &surveyorP{ep: ep, x: x, q: pikago.NewOutbox(ep, 1)}
 	x.Lock()
 	x.peers[ep.GetID()] = peer
 	go peer.receiver()
-	go peer.sender()
 	x.Unlock()
 }
 
@@ -150,7 +132,7 @@ func (x *surveyor) RemoveEndpoint(ep pikago.Endpoint) {
 	x.Unlock()
 
 	if peer != nil {
-		close(peer.q)
+		peer.q.Close()
 	}
 }
 
@@ -182,12 +164,7 @@ func (x *surveyor) SendHook(m *pikago.Message) bool {
 	// fmt.Println("x.surveyID", x.surveyID)
 	x.nextID++
 	x.sock.SetRecvError(nil)
-	v := x.surveyID
-	// fmt.Println("m.Header", m.Header)
-	m.Header = append(m.Header,
-		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
-	// fmt.Println("m.Header", m.Header)
-	// fmt.Println("byte(v>>24), byte(v>>16), byte(v>>8), byte(v)", byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	m.AppendHeaderUint32(x.surveyID)
 	if x.duration > 0 {
 		x.timer.Reset(x.duration)
 	}
@@ -204,13 +181,9 @@ func (x *surveyor) RecvHook(m *pikago.Message) bool {
 	x.Lock()
 	defer x.Unlock()
 
-	if len(m.Header) < 4 {
-		return false
-	}
-	if binary.BigEndian.Uint32(m.Header) != x.surveyID {
+	if id, err := m.PopHeaderUint32(); err != nil || id != x.surveyID {
 		return false
 	}
-	m.Header = m.Header[4:]
 	return true
 }
 
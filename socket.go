@@ -1,5 +1,7 @@
 package pikago
 
+import "context"
+
 //套接字是用于访问SP系统的主访问接口
 //它是应用程序与消息传递拓扑结构的“connection”的抽象
 //应用程序可以一次打开多个套接字
@@ -11,6 +13,7 @@ type Socket interface {
 	Recv() ([]byte, error)
 
 	// 就像Send(),不过SendMsg()应用了message headers.
+	//成功时message归socket所有，调用方不能再使用它；返回错误时message仍归调用方所有，需要时由调用方Free
 	SendMsg(*Message) error
 
 	// RecvMsg 接收一个完整的 message,包含 message header,
@@ -50,4 +53,14 @@ type Socket interface {
 
 	//SetPortHook 设置一个PortHook 函数，当Port添加或者删除的时候调用
 	SetPortHook(PortHook) PortHook
+
+	//WaitForPeers 阻塞直到至少有n个已连接的peer，ctx结束时返回ctx.Err()
+	//Dial在连接建立之前就返回，PUB、BUS、SURVEYOR在没有peer时会丢弃message，可以先调用它等待
+	WaitForPeers(ctx context.Context, n int) error
+
+	//SendTo 和SendMsg一样，但message只发给指定的Port，例如收到message的m.Port
+	//只有BUS、PAIR v1和raw模式的REP、RESPONDENT支持，其它protocol返回ErrProtoOp
+	//Port不属于这个Socket或者已经断开时返回ErrBadPort。发送时Port断开的message被丢弃
+	//raw模式的REP、RESPONDENT用Port代替Header开头的pipe ID，Header只需要包含其余的backtrace
+	SendTo(port Port, m *Message) error
 }
@@ -92,6 +92,7 @@ func (p *inproc) Send(m *pikago.Message) error {
 	nmsg.Body = append(nmsg.Body, m.Body...)
 	select {
 	case p.wq <- nmsg:
+		m.Free()
 		return nil
 	case <-p.closeq:
 		nmsg.Free()
@@ -0,0 +1,125 @@
+// Package transporttest holds the tests and benchmarks shared by the
+// stream transports.  Each transport's test file calls them with its
+// own transport and addresses.
+package transporttest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/k4s/pikago"
+	"github.com/k4s/pikago/protocol/pull"
+	"github.com/k4s/pikago/protocol/push"
+)
+
+// Addr returns an address to listen on.  It is called for each
+// listener, so transports that cannot reuse an address, such as ipc,
+// can return a fresh one.
+type Addr func(tb testing.TB) string
+
+// connect returns a push socket dialed to a pull socket listening on
+// addr, both using tran and with opts set.
+func connect(tb testing.TB, tran func() pikago.Transport, addr string, opts map[string]interface{}) (pikago.Socket, pikago.Socket) {
+	pl, err := pull.NewSocket()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ps, err := push.NewSocket()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, s := range []pikago.Socket{pl, ps} {
+		s.AddTransport(tran())
+		for n, v := range opts {
+			if err = s.SetOption(n, v); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	pl.SetOption(pikago.OptionRecvDeadline, 10*time.Second)
+
+	l, err := pl.NewListener(addr, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = l.Listen(); err != nil {
+		tb.Fatal(err)
+	}
+	if err = ps.Dial(l.Address()); err != nil {
+		tb.Fatal(err)
+	}
+	return ps, pl
+}
+
+// benchSmall measures push to pull throughput of 16 byte messages.
+func benchSmall(b *testing.B, tran func() pikago.Transport, addr string, opts map[string]interface{}) {
+	ps, pl := connect(b, tran, addr, opts)
+	defer pl.Close()
+	defer ps.Close()
+
+	msg := make([]byte, 16)
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if ps.Send(msg) != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		if _, err := pl.Recv(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchSmallMessages runs the small message benchmark with plain,
+// read-buffered and batching pipes.
+func BenchSmallMessages(b *testing.B, tran func() pikago.Transport, addr Addr) {
+	b.Run("Plain", func(b *testing.B) {
+		benchSmall(b, tran, addr(b), nil)
+	})
+	b.Run("ReadBuffer", func(b *testing.B) {
+		benchSmall(b, tran, addr(b), map[string]interface{}{
+			pikago.OptionReadBufferSize: 4096,
+		})
+	})
+	b.Run("Batch", func(b *testing.B) {
+		benchSmall(b, tran, addr(b), map[string]interface{}{
+			pikago.OptionWriteBatchSize: 4096,
+		})
+	})
+}
+
+// TestBatchClose checks that a batching pipe carries messages and that
+// closing it leaves no writer goroutine behind.
+func TestBatchClose(t *testing.T, tran func() pikago.Transport, addr Addr) {
+	before := runtime.NumGoroutine()
+	ps, pl := connect(t, tran, addr(t), map[string]interface{}{
+		pikago.OptionWriteBatchSize: 4096,
+	})
+	for i := 0; i < 10; i++ {
+		if err := ps.Send([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if b, err := pl.Recv(); err != nil || string(b) != "hello" {
+			t.Fatal(string(b), err)
+		}
+	}
+	ps.Close()
+	pl.Close()
+
+	n := 0
+	for i := 0; i < 100; i++ {
+		if n = runtime.NumGoroutine(); n <= before {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%d goroutines left after Close, want at most %d", n, before)
+}
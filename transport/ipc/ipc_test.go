@@ -0,0 +1,23 @@
+package ipc_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/k4s/pikago/transport/internal/transporttest"
+	"github.com/k4s/pikago/transport/ipc"
+)
+
+// addr returns a fresh socket path, since each benchmark run listens
+// again.
+func addr(tb testing.TB) string {
+	return "ipc://" + filepath.Join(tb.TempDir(), "pikago.sock")
+}
+
+func BenchmarkSmallMessages(b *testing.B) {
+	transporttest.BenchSmallMessages(b, ipc.NewTransport, addr)
+}
+
+func TestBatchClose(t *testing.T) {
+	transporttest.TestBatchClose(t, ipc.NewTransport, addr)
+}
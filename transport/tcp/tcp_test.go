@@ -0,0 +1,20 @@
+package tcp_test
+
+import (
+	"testing"
+
+	"github.com/k4s/pikago/transport/internal/transporttest"
+	"github.com/k4s/pikago/transport/tcp"
+)
+
+func addr(testing.TB) string {
+	return "tcp://127.0.0.1:0"
+}
+
+func BenchmarkSmallMessages(b *testing.B) {
+	transporttest.BenchSmallMessages(b, tcp.NewTransport, addr)
+}
+
+func TestBatchClose(t *testing.T) {
+	transporttest.TestBatchClose(t, tcp.NewTransport, addr)
+}